@@ -0,0 +1,71 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFakeClockRetries(t *testing.T) {
+	// fails twice, then succeeds
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(srv.Close)
+
+	const timeout = 30 * time.Second
+	clock := newFakeClock()
+	start := clock.Now()
+	c := NewRestV1Client(srv.URL+"/api/v1", timeout, 3)
+	c.SetClock(clock)
+
+	realStart := time.Now()
+	if _, err := c.Report(ReqReport{APIKey: "key", Server: "db1"}); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(realStart); d > 5*time.Second {
+		t.Errorf("call took %v, want no real waiting", d)
+	}
+
+	// two delays of the timeout plus up to 20%, on the fake clock only
+	if len(clock.slept) != 2 {
+		t.Fatalf("slept %v, want 2 delays", clock.slept)
+	}
+	var total time.Duration
+	for _, d := range clock.slept {
+		if d < timeout || d > timeout*6/5 {
+			t.Errorf("delay %v, want %v to %v", d, timeout, timeout*6/5)
+		}
+		total += d
+	}
+	s := c.LastCallStats()
+	if s.Attempts != 3 {
+		t.Errorf("call made %d attempts, want 3", s.Attempts)
+	}
+	if s.Duration != total || clock.Now().Sub(start) != total {
+		t.Errorf("call took %v by the fake clock, want %v", s.Duration, total)
+	}
+}
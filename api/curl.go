@@ -0,0 +1,108 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// SetDumpCurl sets whether the client prints, to stderr and before the first
+// attempt of each call, a curl command that makes the same HTTP request. The
+// request body is written to a temporary file that the command refers to.
+// Unless full is set, the API key is removed from that body and the HTTP basic
+// auth password is left for curl to prompt for, so that the output can be
+// shared. Requests are not streamed when this is set.
+func (c *RestV1Client) SetDumpCurl(b, full bool) {
+	c.curl = b
+	c.curlAll = full
+}
+
+// dumpCurl prints a curl command equivalent to hr, whose compressed body is
+// body and was made from req. Errors are logged and otherwise ignored.
+func (c *RestV1Client) dumpCurl(hr *http.Request, req interface{}, body []byte) {
+	h := hr.Header.Clone()
+	setContentHeaders(h)
+	if !c.curlAll {
+		buf := &bytes.Buffer{}
+		gzw := gzip.NewWriter(buf)
+		if err := json.NewEncoder(gzw).Encode(withoutAPIKey(req)); err != nil {
+			log.Printf("warning: failed to dump curl command: %v", err)
+			return
+		}
+		gzw.Close()
+		body = buf.Bytes()
+		// keep the digests in step with the body actually written out
+		if len(c.signKey) > 0 {
+			h.Set(c.signHdr, c.sign(body))
+		}
+		if c.md5 {
+			h.Set("Content-MD5", contentMD5(body))
+		}
+	}
+
+	f, err := os.CreateTemp("", "pgdash-request-*.json.gz")
+	if err == nil {
+		_, err = f.Write(body)
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+	}
+	if err != nil {
+		log.Printf("warning: failed to dump curl command: %v", err)
+		return
+	}
+
+	args := []string{"curl", "-X", hr.Method}
+	if len(c.socket) > 0 {
+		args = append(args, "--unix-socket", shellQuote(c.socket))
+	}
+	if len(c.user) > 0 {
+		if c.curlAll {
+			args = append(args, "-u", shellQuote(c.user+":"+c.pass))
+		} else {
+			args = append(args, "-u", shellQuote(c.user))
+		}
+	}
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range h[k] {
+			args = append(args, "-H", shellQuote(k+": "+v))
+		}
+	}
+	args = append(args, "--data-binary", shellQuote("@"+f.Name()), shellQuote(hr.URL.String()))
+	fmt.Fprintln(os.Stderr, strings.Join(args, " "))
+	if !c.curlAll {
+		fmt.Fprintln(os.Stderr, "# the API key has been removed from the request body")
+	}
+}
+
+// shellQuote quotes s for use as a single word in a POSIX shell command.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
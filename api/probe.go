@@ -0,0 +1,188 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ProbeStats holds the results of a connection probe.
+type ProbeStats struct {
+	Addr    string        // host:port of the pgDash server, or the socket path
+	Proxy   string        // host:port of the proxy, if one was used
+	DNS     time.Duration // time taken to resolve the host (or proxy)
+	Connect time.Duration // time taken to connect, including any CONNECT
+	TLS     time.Duration // time taken for the TLS handshake, 0 for http
+	Total   time.Duration
+}
+
+// Probe connects to the server at the base URL, completes the TLS handshake
+// for https URLs, and closes the connection without making any request. It
+// uses the same dialer, proxy and TLS settings as API requests. Only http
+// proxies are supported.
+func (c *RestV1Client) Probe() (s ProbeStats, err error) {
+	if len(c.dir) > 0 {
+		return s, errors.New("cannot probe a file:// base URL")
+	}
+	if len(c.socket) > 0 {
+		s.Addr = c.socket
+		start := time.Now()
+		conn, err := c.dialer.Dial("unix", c.socket)
+		if err != nil {
+			return s, err
+		}
+		conn.Close()
+		s.Connect = time.Since(start)
+		s.Total = s.Connect
+		return s, nil
+	}
+	u, err := url.Parse(c.base)
+	if err != nil {
+		return s, err
+	}
+	tr, ok := c.client.Transport.(*http.Transport)
+	if !ok {
+		return s, errors.New("cannot probe with a custom transport")
+	}
+	port := u.Port()
+	if len(port) == 0 {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	s.Addr = net.JoinHostPort(u.Hostname(), port)
+
+	// find out what we need to connect to
+	target := u
+	var proxy *url.URL
+	if tr.Proxy != nil {
+		if proxy, err = tr.Proxy(&http.Request{URL: u}); err != nil {
+			return s, err
+		}
+	}
+	if proxy != nil {
+		if proxy.Scheme != "http" {
+			return s, fmt.Errorf("%s proxies are not supported", proxy.Scheme)
+		}
+		target = proxy
+		s.Proxy = proxy.Host
+		if len(proxy.Port()) == 0 {
+			s.Proxy = net.JoinHostPort(proxy.Hostname(), "80")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	// resolve
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupHost(ctx, target.Hostname())
+	if err != nil {
+		return s, err
+	}
+	s.DNS = time.Since(start)
+	sortAddrs(addrs, c.prefer)
+
+	// connect, trying each address in turn
+	t := time.Now()
+	tport := target.Port()
+	if len(tport) == 0 {
+		tport = port
+		if proxy != nil {
+			tport = "80"
+		}
+	}
+	var conn net.Conn
+	for _, a := range addrs {
+		if conn, err = c.dialer.DialContext(ctx, "tcp", net.JoinHostPort(a, tport)); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return s, err
+	}
+	defer conn.Close()
+	if dl, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(dl)
+	}
+	if proxy != nil {
+		if err = proxyConnect(conn, proxy, s.Addr); err != nil {
+			return s, err
+		}
+	}
+	s.Connect = time.Since(t)
+
+	// handshake
+	if u.Scheme == "https" {
+		t = time.Now()
+		var cfg *tls.Config
+		if tr.TLSClientConfig != nil {
+			cfg = tr.TLSClientConfig.Clone()
+		} else {
+			cfg = &tls.Config{}
+		}
+		if len(cfg.ServerName) == 0 {
+			cfg.ServerName = u.Hostname()
+		}
+		tc := tls.Client(conn, cfg)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			return s, err
+		}
+		s.TLS = time.Since(t)
+	}
+
+	s.Total = time.Since(start)
+	return s, nil
+}
+
+// proxyConnect asks the http proxy at the other end of conn to open a tunnel
+// to addr.
+func proxyConnect(conn net.Conn, proxy *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if proxy.User != nil {
+		pass, _ := proxy.User.Password()
+		auth := proxy.User.Username() + ":" + pass
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("proxy %s refused to connect: %s", proxy.Host, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// SetNoProxy adds to the hosts for which the proxy from the environment
+// (HTTPS_PROXY or HTTP_PROXY) is not used, which are initially those in
+// NO_PROXY. Each entry can be:
+//
+//   - "*", for all hosts
+//   - a domain name like "example.com", for it and all its subdomains; a
+//     leading "." or "*." is ignored
+//   - an IP address, like "10.1.2.3" or "::1"
+//   - a CIDR block, like "10.0.0.0/8", for IP addresses in it and also for
+//     host names that resolve to one
+//
+// Domain names and IP addresses can be followed by ":port" to match only
+// that port. Unlike the standard library, CIDR blocks match host names too,
+// which are looked up at most once per client for this, and entries added
+// here take effect even after the environment has been read once by the
+// process.
+func (c *RestV1Client) SetNoProxy(hosts []string) {
+	for _, h := range hosts {
+		if h = strings.TrimSpace(h); len(h) > 0 {
+			c.noProxy = append(c.noProxy, h)
+		}
+	}
+}
+
+// envNoProxy returns the entries of NO_PROXY (or no_proxy).
+func envNoProxy() []string {
+	v := os.Getenv("NO_PROXY")
+	if len(v) == 0 {
+		v = os.Getenv("no_proxy")
+	}
+	var hosts []string
+	for _, h := range strings.Split(v, ",") {
+		if h = strings.TrimSpace(h); len(h) > 0 {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// proxy is the Proxy function of the client's transport. It uses the proxy
+// from the environment, unless the host is matched by a no-proxy entry.
+func (c *RestV1Client) proxy(req *http.Request) (*url.URL, error) {
+	if bypassProxy(c.noProxy, req.URL, c.resolveOnce) {
+		return nil, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// resolveOnce is like resolveHost, but remembers the addresses of each host,
+// so that matching CIDR entries costs at most one lookup per host rather than
+// one per request.
+func (c *RestV1Client) resolveOnce(host string) []net.IP {
+	c.npMu.Lock()
+	defer c.npMu.Unlock()
+	if ips, ok := c.npAddrs[host]; ok {
+		return ips
+	}
+	ips := resolveHost(host)
+	if c.npAddrs == nil {
+		c.npAddrs = make(map[string][]net.IP)
+	}
+	c.npAddrs[host] = ips
+	return ips
+}
+
+// resolveTimeout limits the time taken to resolve a host name for matching
+// it against no-proxy CIDR entries.
+const resolveTimeout = 2 * time.Second
+
+// resolveHost returns the IP addresses of host, or none if it cannot be
+// resolved within resolveTimeout.
+func resolveHost(host string) []net.IP {
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+	return ips
+}
+
+// bypassProxy returns true if any of the no-proxy entries, described at
+// SetNoProxy, matches the host and port of u. Host names are resolved with
+// resolve only if there are CIDR entries to check, and at most once.
+func bypassProxy(entries []string, u *url.URL, resolve func(string) []net.IP) bool {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	port := u.Port()
+	if len(port) == 0 {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	hostIP := net.ParseIP(host)
+	var addrs []net.IP
+	resolved := false
+
+	for _, e := range entries {
+		e = strings.ToLower(e)
+		if e == "*" {
+			return true
+		}
+		if _, block, err := net.ParseCIDR(e); err == nil {
+			if hostIP != nil {
+				if block.Contains(hostIP) {
+					return true
+				}
+				continue
+			}
+			if !resolved {
+				addrs, resolved = resolve(host), true
+			}
+			for _, ip := range addrs {
+				if block.Contains(ip) {
+					return true
+				}
+			}
+			continue
+		}
+
+		// split off the port, if any; IPv6 addresses need brackets for it
+		ePort := ""
+		if h, p, err := net.SplitHostPort(e); err == nil {
+			e, ePort = h, p
+		} else {
+			e = strings.Trim(e, "[]")
+		}
+		if len(ePort) > 0 && ePort != port {
+			continue
+		}
+		if ip := net.ParseIP(e); ip != nil {
+			if hostIP != nil && ip.Equal(hostIP) {
+				return true
+			}
+			continue
+		}
+		e = strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(e, "*"), "."), ".")
+		if len(e) > 0 && (host == e || strings.HasSuffix(host, "."+e)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,128 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestBypassProxy(t *testing.T) {
+	tests := []struct {
+		entries string // comma-separated
+		url     string
+		want    bool
+	}{
+		// domains, with and without a leading "." or "*."
+		{"example.com", "https://example.com/", true},
+		{"example.com", "https://pgdash.example.com/", true},
+		{"example.com", "https://notexample.com/", false},
+		{".example.com", "https://example.com/", true},
+		{".example.com", "https://a.b.example.com/", true},
+		{"*.example.com", "https://pgdash.example.com/", true},
+		{"Example.COM.", "https://pgdash.example.com./", true},
+		{"pgdash.example.com", "https://example.com/", false},
+
+		// ports, including the scheme defaults
+		{"example.com:8443", "https://example.com:8443/", true},
+		{"example.com:8443", "https://example.com/", false},
+		{"example.com:443", "https://example.com/", true},
+		{"example.com:80", "http://example.com/", true},
+		{"example.com:80", "https://example.com/", false},
+
+		// IP addresses
+		{"10.1.2.3", "http://10.1.2.3:8080/", true},
+		{"10.1.2.3:8080", "http://10.1.2.3:8080/", true},
+		{"10.1.2.3:9090", "http://10.1.2.3:8080/", false},
+		{"::1", "http://[::1]:8080/", true},
+		{"[::1]:8080", "http://[::1]:8080/", true},
+		{"10.1.2.3", "http://internal.corp/", false},
+
+		// CIDR blocks, for addresses and host names resolving into them
+		{"10.0.0.0/8", "http://10.9.8.7/", true},
+		{"10.0.0.0/8", "http://11.9.8.7/", false},
+		{"10.0.0.0/8", "http://internal.corp/", true},
+		{"10.0.0.0/8", "http://external.corp/", false},
+		{"10.0.0.0/8", "http://unknown.corp/", false},
+		{"fd00::/8", "http://[fd00::1]/", true},
+		{"fd00::/8", "http://[fe80::1]/", false},
+		{"fd00::/8", "http://v6.corp/", true},
+
+		// everything, and nothing
+		{"*", "https://anything.example.org:1234/", true},
+		{"", "https://example.com/", false},
+		{",,", "https://example.com/", false},
+		{"other.com,*", "https://example.com/", true},
+	}
+	resolve := func(host string) []net.IP {
+		switch host {
+		case "internal.corp":
+			return []net.IP{net.ParseIP("10.1.2.3")}
+		case "external.corp":
+			return []net.IP{net.ParseIP("203.0.113.5")}
+		case "v6.corp":
+			return []net.IP{net.ParseIP("203.0.113.6"), net.ParseIP("fd00::6")}
+		}
+		return nil
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bypassProxy(strings.Split(tt.entries, ","), u, resolve); got != tt.want {
+			t.Errorf("entries %q, URL %s: got %v, want %v", tt.entries, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestBypassProxyResolves(t *testing.T) {
+	tests := []struct {
+		entries string
+		url     string
+		want    int // number of lookups
+	}{
+		{"example.com,10.1.2.3", "http://internal.corp/", 0},
+		{"10.0.0.0/8", "http://10.1.2.3/", 0},
+		{"10.0.0.0/8,192.168.0.0/16,fd00::/8", "http://internal.corp/", 1},
+		{"internal.corp,10.0.0.0/8", "http://internal.corp/", 0},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		var n int
+		bypassProxy(strings.Split(tt.entries, ","), u, func(string) []net.IP {
+			n++
+			return nil
+		})
+		if n != tt.want {
+			t.Errorf("entries %q, URL %s: resolved %d times, want %d", tt.entries, tt.url, n, tt.want)
+		}
+	}
+}
+
+func TestResolveOnce(t *testing.T) {
+	c := NewRestV1Client("http://localhost/api/v1", 0, 1)
+	c.npAddrs = map[string][]net.IP{"internal.corp": {net.ParseIP("10.1.2.3")}}
+	c.SetNoProxy([]string{"10.0.0.0/8"})
+	for i := 0; i < 3; i++ {
+		if ips := c.resolveOnce("internal.corp"); len(ips) != 1 || !ips[0].Equal(net.ParseIP("10.1.2.3")) {
+			t.Fatalf("got %v, want the remembered address", ips)
+		}
+	}
+}
@@ -18,6 +18,7 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"regexp"
 
 	"github.com/rapidloop/pgmetrics"
@@ -72,3 +73,31 @@ type ReqReportPgpool struct {
 	Pgpool string          `json:"pgpool"`
 	Data   pgmetrics.Model `json:"data"`
 }
+
+//------------------------------------------------------------------------------
+// Raw variants
+
+// ReqReportRaw is like ReqReport, but carries the JSON-encoded pgmetrics model
+// as-is.
+type ReqReportRaw struct {
+	APIKey string          `json:"apikey"`
+	Server string          `json:"server"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// ReqReportPgBouncerRaw is like ReqReportPgBouncer, but carries the
+// JSON-encoded pgmetrics model as-is.
+type ReqReportPgBouncerRaw struct {
+	APIKey    string          `json:"apikey"`
+	Server    string          `json:"server"`
+	PgBouncer string          `json:"pgbouncer"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// ReqReportPgpoolRaw is like ReqReportPgpool, but carries the JSON-encoded
+// pgmetrics model as-is.
+type ReqReportPgpoolRaw struct {
+	APIKey string          `json:"apikey"`
+	Pgpool string          `json:"pgpool"`
+	Data   json.RawMessage `json:"data"`
+}
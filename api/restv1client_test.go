@@ -0,0 +1,435 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// instantClock is a Clock that does not wait.
+type instantClock struct{}
+
+func (instantClock) Now() time.Time {
+	return time.Now()
+}
+
+func (instantClock) Sleep(ctx context.Context, d time.Duration) error {
+	return ctx.Err()
+}
+
+// fakeClock is a Clock whose time only moves when it sleeps.
+type fakeClock struct {
+	mu    sync.Mutex
+	now   time.Time
+	slept []time.Duration
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Now()}
+}
+
+func (f *fakeClock) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+func (f *fakeClock) Sleep(ctx context.Context, d time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+	f.slept = append(f.slept, d)
+	return ctx.Err()
+}
+
+// newTestServer returns a server that always responds with the given HTTP
+// status code, and counts the requests it gets in hits.
+func newTestServer(t *testing.T, code int, hits *int32) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		w.WriteHeader(code)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestCallCanceledDuringBackoff(t *testing.T) {
+	var hits int32
+	srv := newTestServer(t, http.StatusServiceUnavailable, &hits)
+
+	// the delay before the second attempt is at least the timeout
+	c := NewRestV1Client(srv.URL+"/api/v1", 10*time.Second, 5)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c.SetAttemptObserver(func(a Attempt) {
+		if a.Retry {
+			go func() {
+				time.Sleep(50 * time.Millisecond) // let the backoff begin
+				cancel()
+			}()
+		}
+	})
+
+	start := time.Now()
+	_, err := c.ReportContext(ctx, ReqReport{APIKey: "key", Server: "db1"})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("call returned %v after the start, want it right after canceling", d)
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("server got %d requests, want 1", n)
+	}
+}
+
+func TestGatewayErrorsRetried(t *testing.T) {
+	tests := []struct {
+		code    int
+		gateway bool
+	}{
+		{http.StatusBadGateway, true},
+		{http.StatusServiceUnavailable, true},
+		{http.StatusGatewayTimeout, true},
+		{http.StatusInternalServerError, false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.code), func(t *testing.T) {
+			var hits int32
+			srv := newTestServer(t, tt.code, &hits)
+
+			var logs bytes.Buffer
+			log.SetOutput(&logs)
+			defer log.SetOutput(os.Stderr)
+
+			c := NewRestV1Client(srv.URL+"/api/v1", time.Second, 3)
+			c.SetClock(instantClock{})
+			c.SetDebug(true)
+			_, err := c.Report(ReqReport{APIKey: "key", Server: "db1"})
+
+			var errh *RestV1ClientError
+			if !errors.As(err, &errh) {
+				t.Fatalf("got error %v, want a RestV1ClientError", err)
+			}
+			if errh.Code() != tt.code {
+				t.Errorf("got code %d, want %d", errh.Code(), tt.code)
+			}
+			if errh.IsGatewayError() != tt.gateway {
+				t.Errorf("IsGatewayError() = %v, want %v", errh.IsGatewayError(), tt.gateway)
+			}
+			if n := atomic.LoadInt32(&hits); n != 3 {
+				t.Errorf("server got %d requests, want 3", n)
+			}
+			gw := fmt.Sprintf("gateway error: HTTP %d", tt.code)
+			if got := strings.Contains(logs.String(), gw); got != tt.gateway {
+				t.Errorf("logged %q: %v, want %v; log:\n%s", gw, got, tt.gateway, logs.String())
+			}
+			if se := fmt.Sprintf("server error: HTTP %d", tt.code); !tt.gateway && !strings.Contains(logs.String(), se) {
+				t.Errorf("did not log %q; log:\n%s", se, logs.String())
+			}
+		})
+	}
+}
+
+func TestVersionedBaseURL(t *testing.T) {
+	tests := []struct {
+		root    string
+		version string
+		want    string // empty if an error is expected
+	}{
+		{"https://app.pgdash.io", "v1", "https://app.pgdash.io/api/v1"},
+		{"https://app.pgdash.io/", "v1", "https://app.pgdash.io/api/v1"},
+		{"https://app.pgdash.io/api/v1", "v1", "https://app.pgdash.io/api/v1"},
+		{"https://app.pgdash.io/api/v1/", "v1", "https://app.pgdash.io/api/v1"},
+		{"https://app.pgdash.io/api/v1//", "v1", "https://app.pgdash.io/api/v1"},
+		{"https://host/pgdash", "v1", "https://host/pgdash/api/v1"},
+		{"https://host/pgdash/v1", "v1", "https://host/pgdash/v1/api/v1"},
+		{"https://app.pgdash.io/api/v2", "v1", ""},
+		{"https://app.pgdash.io/api/v1/report", "v1", ""},
+		{"https://app.pgdash.io", "v2", ""},
+		{"file:///tmp/out/", "v1", "file:///tmp/out/"},
+		{"unix:///run/pgdash.sock", "v1", "unix:///run/pgdash.sock?path=/api/v1"},
+		{"unix:///run/pgdash.sock?path=/api/v1/", "v1", "unix:///run/pgdash.sock?path=/api/v1"},
+	}
+	for _, tc := range tests {
+		got, err := VersionedBaseURL(tc.root, tc.version)
+		if tc.want == "" {
+			if err == nil {
+				t.Errorf("VersionedBaseURL(%q, %q) = %q, want error", tc.root, tc.version, got)
+			}
+		} else if err != nil || got != tc.want {
+			t.Errorf("VersionedBaseURL(%q, %q) = %q, %v; want %q", tc.root, tc.version, got, err, tc.want)
+		}
+	}
+}
+
+// redirected is what the redirect target of newRedirectServer got.
+type redirected struct {
+	method string
+	req    ReqReportRaw
+}
+
+// newRedirectServer returns a server that redirects reports with the given
+// HTTP status code to another path, where the method and the decoded body of
+// the request are sent to got.
+func newRedirectServer(t *testing.T, code int, got chan<- redirected) *httptest.Server {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/report", func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		http.Redirect(w, r, "/moved/api/v1/report", code)
+	})
+	mux.HandleFunc("/moved/api/v1/report", func(w http.ResponseWriter, r *http.Request) {
+		var rd redirected
+		rd.method = r.Method
+		zr, err := gzip.NewReader(r.Body)
+		if err == nil {
+			err = json.NewDecoder(zr).Decode(&rd.req)
+		}
+		if err != nil {
+			t.Errorf("redirect target: failed to decode body: %v", err)
+		}
+		got <- rd
+		w.Write([]byte("{}"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRedirectKeepsMethodAndBody(t *testing.T) {
+	data := json.RawMessage(`{"meta":{"version":"1.17.0"},"queries":"` + strings.Repeat("x", 100000) + `"}`)
+	for _, code := range []int{
+		http.StatusMovedPermanently,
+		http.StatusFound,
+		http.StatusTemporaryRedirect,
+		http.StatusPermanentRedirect,
+	} {
+		t.Run(fmt.Sprint(code), func(t *testing.T) {
+			got := make(chan redirected, 1)
+			srv := newRedirectServer(t, code, got)
+			c := NewRestV1Client(srv.URL+"/api/v1", 5*time.Second, 1)
+			if _, err := c.ReportRaw(ReqReportRaw{APIKey: "key", Server: "db1", Data: data}); err != nil {
+				t.Fatal(err)
+			}
+			rd := <-got
+			if rd.method != http.MethodPost {
+				t.Errorf("redirect target got method %s, want POST", rd.method)
+			}
+			if rd.req.Server != "db1" || !bytes.Equal(rd.req.Data, data) {
+				t.Errorf("redirect target got server %q and %d bytes of data, want db1 and %d bytes",
+					rd.req.Server, len(rd.req.Data), len(data))
+			}
+		})
+	}
+}
+
+func TestNoFollowRedirects(t *testing.T) {
+	got := make(chan redirected, 1)
+	srv := newRedirectServer(t, http.StatusFound, got)
+	c := NewRestV1Client(srv.URL+"/api/v1", 5*time.Second, 3)
+	c.SetFollowRedirects(false)
+	_, err := c.ReportRaw(ReqReportRaw{APIKey: "key", Server: "db1", Data: json.RawMessage("{}")})
+	var errh *RestV1ClientError
+	if !errors.As(err, &errh) || errh.Code() != http.StatusFound {
+		t.Fatalf("got error %v, want HTTP 302", err)
+	}
+	if !strings.Contains(err.Error(), "/moved/api/v1/report") {
+		t.Errorf("error %q does not mention the new location", err)
+	}
+	select {
+	case <-got:
+		t.Error("redirect was followed")
+	default:
+	}
+}
+
+// bodyErrTransport is a RoundTripper that records the error, other than EOF,
+// that reading the request bodies ends with.
+type bodyErrTransport struct {
+	rt  http.RoundTripper
+	mu  sync.Mutex
+	err error
+}
+
+func (t *bodyErrTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body = &bodyErrReader{ReadCloser: req.Body, t: t}
+	}
+	return t.rt.RoundTrip(req)
+}
+
+func (t *bodyErrTransport) bodyErr() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+type bodyErrReader struct {
+	io.ReadCloser
+	t *bodyErrTransport
+}
+
+func (r *bodyErrReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		r.t.mu.Lock()
+		r.t.err = err
+		r.t.mu.Unlock()
+	}
+	return n, err
+}
+
+func TestStreamingEncoderFails(t *testing.T) {
+	type result struct {
+		n   int
+		err error
+	}
+	var hits int32
+	got := make(chan result, 3)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		b, err := io.ReadAll(r.Body)
+		got <- result{len(b), err}
+		w.Write([]byte("{}"))
+	}))
+	t.Cleanup(srv.Close)
+
+	// the encoder writes part of the body before failing
+	errEncode := errors.New("model changed while encoding")
+	const written = 256 * 1024
+	tr := &bodyErrTransport{rt: srv.Client().Transport}
+	c := NewRestV1Client(srv.URL+"/api/v1", 5*time.Second, 3)
+	c.SetClock(instantClock{})
+	c.SetTransport(tr)
+	c.SetStreaming(true)
+	c.encode = func(w io.Writer, req interface{}) error {
+		if _, err := w.Write(bytes.Repeat([]byte("x"), written)); err != nil {
+			return err
+		}
+		return errEncode
+	}
+
+	_, err := c.Report(ReqReport{APIKey: "key", Server: "db1"})
+	if !errors.Is(err, errEncode) {
+		t.Fatalf("got error %v, want the encoding error", err)
+	}
+	if err := tr.bodyErr(); !errors.Is(err, errEncode) {
+		t.Errorf("reading the request body ended with %v, want the encoding error", err)
+	}
+	select {
+	case r := <-got:
+		// the chunked body ends without its last chunk
+		if r.err == nil || r.n > written {
+			t.Errorf("server read %d bytes with error %v, want an aborted body", r.n, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("server did not see the request")
+	}
+	if n := atomic.LoadInt32(&hits); n != 1 {
+		t.Errorf("server got %d requests, want 1", n)
+	}
+	if s := c.LastCallStats(); s.Attempts != 1 {
+		t.Errorf("call made %d attempts, want 1", s.Attempts)
+	}
+}
+
+func TestRetryDeadline(t *testing.T) {
+	// the delay before a retry is the timeout plus up to 20%, so 10-12s
+	const timeout = 10 * time.Second
+	tests := []struct {
+		name      string
+		remaining time.Duration
+		hits      int32
+	}{
+		{"no time for the delay", 5 * time.Second, 1},
+		{"no time for the next attempt", 15 * time.Second, 1},
+		{"time for the next attempt", 25 * time.Second, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits int32
+			srv := newTestServer(t, http.StatusServiceUnavailable, &hits)
+			clock := newFakeClock()
+			ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(tt.remaining))
+			defer cancel()
+
+			c := NewRestV1Client(srv.URL+"/api/v1", timeout, 2)
+			c.SetClock(clock)
+			_, err := c.ReportContext(ctx, ReqReport{APIKey: "key", Server: "db1"})
+			var errh *RestV1ClientError
+			if !errors.As(err, &errh) || errh.Code() != http.StatusServiceUnavailable {
+				t.Fatalf("got error %v, want HTTP 503", err)
+			}
+			if n := atomic.LoadInt32(&hits); n != tt.hits {
+				t.Errorf("server got %d requests, want %d", n, tt.hits)
+			}
+			if n := len(clock.slept); int32(n) != tt.hits-1 {
+				t.Errorf("slept %d times, want %d", n, tt.hits-1)
+			}
+		})
+	}
+}
+
+func TestConnectionReused(t *testing.T) {
+	var conns int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte("{}"))
+	}))
+	srv.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	c := NewRestV1Client(srv.URL+"/api/v1", 5*time.Second, 1)
+	for i := 0; i < 5; i++ {
+		if _, err := c.Report(ReqReport{APIKey: "key", Server: fmt.Sprintf("db%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+		want := 0
+		if i == 0 {
+			want = 1
+		}
+		if n := c.LastCallStats().Conns; n != want {
+			t.Errorf("report %d made %d new connections, want %d", i+1, n, want)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 1 {
+		t.Errorf("server got %d connections, want 1", n)
+	}
+}
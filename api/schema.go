@@ -0,0 +1,243 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rapidloop/pgmetrics"
+)
+
+// SchemaError describes a place where a JSON document does not match the
+// structure of the pgmetrics model.
+type SchemaError struct {
+	Path string // location in the document, like "databases[2].size"
+	Msg  string
+}
+
+// Error returns a human-readable error message.
+func (e SchemaError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+var (
+	unmarshalerType     = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// ValidateSchema checks the JSON-encoded document against the structure of
+// the pgmetrics.Model type, and returns all the violations found. The schema is
+// derived from the Go types themselves, and is always in sync with what is
+// decoded. Unlike json.Unmarshal, fields not known to the model, and nulls in
+// places that cannot be null, are also reported.
+func ValidateSchema(data []byte) []SchemaError {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return []SchemaError{{Path: "(root)", Msg: err.Error()}}
+	}
+	var errs []SchemaError
+	checkValue("", doc, reflect.TypeOf(pgmetrics.Model{}), &errs)
+	return errs
+}
+
+func checkValue(path string, v interface{}, t reflect.Type, errs *[]SchemaError) {
+	fail := func(format string, args ...interface{}) {
+		p := path
+		if len(p) == 0 {
+			p = "(root)"
+		}
+		*errs = append(*errs, SchemaError{Path: p, Msg: fmt.Sprintf(format, args...)})
+	}
+	if reflect.PointerTo(t).Implements(unmarshalerType) ||
+		reflect.PointerTo(t).Implements(textUnmarshalerType) {
+		return // has its own encoding, cannot check
+	}
+	if v == nil {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Map, reflect.Interface:
+		default:
+			fail("null not allowed, expected %s", kindName(t))
+		}
+		return
+	}
+	switch t.Kind() {
+	case reflect.Ptr:
+		checkValue(path, v, t.Elem(), errs)
+	case reflect.Interface:
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fail("expected object, got %s", jsonKind(v))
+			return
+		}
+		fields := structFields(t)
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := joinPath(path, k)
+			if f, ok := fields[k]; ok {
+				checkValue(p, obj[k], f.Type, errs)
+			} else {
+				*errs = append(*errs, SchemaError{Path: p, Msg: "unknown field"})
+			}
+		}
+	case reflect.Map:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			fail("expected object, got %s", jsonKind(v))
+			return
+		}
+		keys := make([]string, 0, len(obj))
+		for k := range obj {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := fmt.Sprintf("%s[%q]", path, k)
+			switch t.Key().Kind() {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				if _, err := strconv.ParseInt(k, 10, 64); err != nil {
+					*errs = append(*errs, SchemaError{Path: p, Msg: "key is not an integer"})
+				}
+			}
+			checkValue(p, obj[k], t.Elem(), errs)
+		}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			if _, ok := v.(string); !ok {
+				fail("expected base64 string, got %s", jsonKind(v))
+			}
+			return
+		}
+		arr, ok := v.([]interface{})
+		if !ok {
+			fail("expected array, got %s", jsonKind(v))
+			return
+		}
+		for i, e := range arr {
+			checkValue(fmt.Sprintf("%s[%d]", path, i), e, t.Elem(), errs)
+		}
+	case reflect.String:
+		if _, ok := v.(string); !ok {
+			fail("expected string, got %s", jsonKind(v))
+		}
+	case reflect.Bool:
+		if _, ok := v.(bool); !ok {
+			fail("expected boolean, got %s", jsonKind(v))
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, ok := v.(json.Number)
+		if !ok {
+			fail("expected integer, got %s", jsonKind(v))
+		} else if _, err := strconv.ParseInt(string(n), 10, t.Bits()); err != nil {
+			fail("expected integer, got %s", n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, ok := v.(json.Number)
+		if !ok {
+			fail("expected unsigned integer, got %s", jsonKind(v))
+		} else if _, err := strconv.ParseUint(string(n), 10, t.Bits()); err != nil {
+			fail("expected unsigned integer, got %s", n)
+		}
+	case reflect.Float32, reflect.Float64:
+		if _, ok := v.(json.Number); !ok {
+			fail("expected number, got %s", jsonKind(v))
+		}
+	}
+}
+
+// structFields returns the fields of the struct type t, keyed by their JSON
+// names. Fields of embedded structs are included.
+func structFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && len(name) == 0 {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for k, v := range structFields(ft) {
+					if _, ok := fields[k]; !ok {
+						fields[k] = v
+					}
+				}
+				continue
+			}
+		}
+		if len(name) == 0 {
+			name = f.Name
+		}
+		fields[name] = f
+	}
+	return fields
+}
+
+func joinPath(path, key string) string {
+	if len(path) == 0 {
+		return key
+	}
+	return path + "." + key
+}
+
+func kindName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Struct:
+		return "object"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	}
+	return "integer"
+}
+
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	}
+	return "null"
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/rapidloop/pgmetrics"
+)
+
+// Sections returns the names of the top-level sections of the pgmetrics model,
+// like "databases" and "pgbouncer", as they appear in the JSON form.
+func Sections() []string {
+	var names []string
+	for name := range structFields(reflect.TypeOf(pgmetrics.Model{})) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ExpandSection returns the sections matched by name. This is the section
+// itself if there is one, else all sections named like "name_*", so that
+// "replication" matches "replication_incoming" and "replication_outgoing".
+// It returns nil if nothing matches.
+func ExpandSection(name string) []string {
+	var matches []string
+	for _, s := range Sections() {
+		if s == name {
+			return []string{s}
+		}
+		if strings.HasPrefix(s, name+"_") {
+			matches = append(matches, s)
+		}
+	}
+	return matches
+}
+
+// CheckSections returns an error if, for any of the given names, none of the
+// sections it matches are present and non-empty in the JSON-encoded model.
+func CheckSections(data []byte, names []string) error {
+	var peek map[string]interface{}
+	if err := json.Unmarshal(data, &peek); err != nil {
+		return err
+	}
+	for _, name := range names {
+		found := false
+		for _, s := range ExpandSection(name) {
+			found = found || !isEmpty(peek[s])
+		}
+		if !found {
+			return fmt.Errorf("section %q is missing or empty", name)
+		}
+	}
+	return nil
+}
+
+// IsEmptyModel returns true if data has no report to send: it is blank, or a
+// JSON null, or an object in which all sections other than "meta" are missing
+// or empty. Invalid JSON is not considered empty.
+func IsEmptyModel(data []byte) bool {
+	if len(bytes.TrimSpace(data)) == 0 {
+		return true
+	}
+	var peek map[string]interface{}
+	if err := json.Unmarshal(data, &peek); err != nil {
+		return false
+	}
+	for name, v := range peek {
+		if name != "meta" && !isEmpty(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// isEmpty returns true if v, a decoded JSON value, is null, an empty object or
+// array, or a zero value.
+func isEmpty(v interface{}) bool {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return len(v) == 0
+	case []interface{}:
+		return len(v) == 0
+	case string:
+		return len(v) == 0
+	case float64:
+		return v == 0
+	case bool:
+		return !v
+	}
+	return v == nil
+}
+
+// FilterSections returns the JSON-encoded model in data with only the sections
+// matched by the include names, if any, and without the ones matched by the
+// exclude names. The "meta" section is always kept, since a report cannot be
+// processed without it.
+func FilterSections(data []byte, include, exclude []string) ([]byte, error) {
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(data, &sections); err != nil {
+		return nil, err
+	}
+	if len(include) > 0 {
+		keep := map[string]bool{"meta": true}
+		for _, name := range include {
+			for _, s := range ExpandSection(name) {
+				keep[s] = true
+			}
+		}
+		for s := range sections {
+			if !keep[s] {
+				delete(sections, s)
+			}
+		}
+	}
+	for _, name := range exclude {
+		for _, s := range ExpandSection(name) {
+			if s != "meta" {
+				delete(sections, s)
+			}
+		}
+	}
+	return json.Marshal(sections)
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http/httptrace"
+	"strings"
+	"time"
+)
+
+// phaseTimer records the time taken by each phase of an HTTP request.
+type phaseTimer struct {
+	start, dnsStart, dnsDone, connStart, connDone, tlsStart, tlsDone time.Time
+	gotConn, wrote, firstByte                                        time.Time
+	reused                                                           bool
+}
+
+func newPhaseTimer() *phaseTimer {
+	return &phaseTimer{start: time.Now()}
+}
+
+func (p *phaseTimer) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { p.dnsStart = time.Now() },
+		DNSDone:           func(httptrace.DNSDoneInfo) { p.dnsDone = time.Now() },
+		ConnectStart:      func(_, _ string) { p.connStart = time.Now() },
+		ConnectDone:       func(_, _ string, _ error) { p.connDone = time.Now() },
+		TLSHandshakeStart: func() { p.tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { p.tlsDone = time.Now() },
+		GotConn: func(i httptrace.GotConnInfo) {
+			p.gotConn = time.Now()
+			p.reused = i.Reused
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { p.wrote = time.Now() },
+		GotFirstResponseByte: func() { p.firstByte = time.Now() },
+	}
+}
+
+// log logs the time taken by each phase that was completed.
+func (p *phaseTimer) log() {
+	var b strings.Builder
+	phase := func(name string, from, to time.Time) {
+		if !from.IsZero() && !to.IsZero() {
+			fmt.Fprintf(&b, " %s=%v", name, to.Sub(from).Round(time.Microsecond))
+		}
+	}
+	phase("dns", p.dnsStart, p.dnsDone)
+	phase("connect", p.connStart, p.connDone)
+	phase("tls", p.tlsStart, p.tlsDone)
+	phase("send", p.gotConn, p.wrote)
+	phase("ttfb", p.wrote, p.firstByte)
+	phase("total", p.start, time.Now())
+	log.Printf("trace: reused=%v%s", p.reused, b.String())
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rapidloop/pgmetrics"
+)
+
+// Payload is the kind of information a model is expected to carry.
+type Payload int
+
+const (
+	// PayloadPostgres is for models about a PostgreSQL server. Such models
+	// must not contain PgBouncer information.
+	PayloadPostgres Payload = iota
+
+	// PayloadPgBouncer is for models that contain PgBouncer information.
+	PayloadPgBouncer
+
+	// PayloadPgpool is for models that contain Pgpool information.
+	PayloadPgpool
+
+	// PayloadAny is for models that may carry any kind of information.
+	PayloadAny
+)
+
+var (
+	// ErrHasPgBouncer is returned by ValidateModel if a PayloadPostgres model
+	// contains PgBouncer information.
+	ErrHasPgBouncer = errors.New("pgmetrics report contains PgBouncer information")
+
+	// ErrNoPgBouncer is returned by ValidateModel if a PayloadPgBouncer model
+	// does not contain PgBouncer information.
+	ErrNoPgBouncer = errors.New("pgmetrics report does not contain PgBouncer information")
+
+	// ErrNoPgpool is returned by ValidateModel if a PayloadPgpool model does
+	// not contain Pgpool information.
+	ErrNoPgpool = errors.New("pgmetrics report does not contain Pgpool information")
+)
+
+// ValidateOptions controls the checks done by ValidateModel.
+type ValidateOptions struct {
+	// SupportedMajor is the major version of the pgmetrics JSON schema that
+	// is acceptable.
+	SupportedMajor int
+
+	// Window is the maximum allowed difference between the collection
+	// timestamp of the model and Now, in either direction.
+	Window time.Duration
+
+	// Now is the time to check the collection timestamp against. If zero,
+	// the current time is used.
+	Now time.Time
+
+	// NoTimeCheck disables the check of the collection timestamp.
+	NoTimeCheck bool
+
+	// Payload is the kind of information the model must carry.
+	Payload Payload
+
+	// OnVersionMismatch, if not nil, is called with the error when the
+	// major version of the schema is not SupportedMajor, and the model is
+	// checked further instead of being rejected.
+	OnVersionMismatch func(err error)
+}
+
+// DefaultValidateOptions returns the options used by the pgdash CLI, for
+// a PayloadPostgres model.
+func DefaultValidateOptions() ValidateOptions {
+	return ValidateOptions{
+		SupportedMajor: 1,
+		Window:         180 * 24 * time.Hour,
+	}
+}
+
+// ValidateModel checks if the model is acceptable for reporting. It does not
+// modify the model.
+func ValidateModel(m *pgmetrics.Model, opts ValidateOptions) error {
+	// check the schema version
+	ver := m.Metadata.Version
+	if !strings.HasPrefix(ver, fmt.Sprintf("%d.", opts.SupportedMajor)) {
+		err := fmt.Errorf("bad schema version '%s' in pgmetrics json", ver)
+		if opts.OnVersionMismatch == nil {
+			return err
+		}
+		opts.OnVersionMismatch(err)
+	}
+
+	// check the collection timestamp
+	at := time.Unix(m.Metadata.At, 0)
+	now := opts.Now
+	if now.IsZero() {
+		now = time.Now()
+	}
+	if !opts.NoTimeCheck && (at.Before(now.Add(-opts.Window)) || at.After(now.Add(opts.Window))) {
+		return fmt.Errorf("bad collection timestamp in pgmetrics json: %v", at)
+	}
+
+	// check the payload
+	switch opts.Payload {
+	case PayloadPostgres:
+		if m.PgBouncer != nil {
+			return ErrHasPgBouncer
+		}
+	case PayloadPgBouncer:
+		if m.PgBouncer == nil {
+			return ErrNoPgBouncer
+		}
+	case PayloadPgpool:
+		if m.Pgpool == nil {
+			return ErrNoPgpool
+		}
+	}
+
+	return nil
+}
+
+// ValidateRaw is like ValidateModel, but works on the JSON-encoded form of the
+// model. Only the fields required for validation are decoded, so that fields
+// not known to this version of pgmetrics do not affect the result.
+func ValidateRaw(data []byte, opts ValidateOptions) error {
+	var peek map[string]json.RawMessage
+	if err := json.Unmarshal(data, &peek); err != nil {
+		return err
+	}
+	var m pgmetrics.Model
+	if meta, ok := peek["meta"]; ok {
+		if err := json.Unmarshal(meta, &m.Metadata); err != nil {
+			return err
+		}
+	}
+	if isPresent(peek["pgbouncer"]) {
+		m.PgBouncer = &pgmetrics.PgBouncer{}
+	}
+	if isPresent(peek["pgpool"]) {
+		m.Pgpool = &pgmetrics.Pgpool{}
+	}
+	return ValidateModel(&m, opts)
+}
+
+func isPresent(v json.RawMessage) bool {
+	return len(v) > 0 && string(v) != "null"
+}
@@ -0,0 +1,289 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/rapidloop/pgdash/api"
+	"github.com/rapidloop/pgmetrics"
+)
+
+// openArchive opens the tar archive at name, transparently decompressing it
+// if it is gzipped.
+func openArchive(name string) (*tar.Reader, io.Closer, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(f)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return tar.NewReader(zr), f, nil
+	}
+	return tar.NewReader(br), f, nil
+}
+
+// archiveServer returns the server name for the tar entry hdr, or an empty
+// string if the entry is not a pgmetrics JSON file. The name is the base name
+// of the file without the .json extension, so that "2023-06-01/db1.json"
+// is reported as "db1".
+func archiveServer(hdr *tar.Header) string {
+	if hdr.Typeflag != tar.TypeReg {
+		return ""
+	}
+	base := path.Base(hdr.Name)
+	if strings.HasPrefix(base, ".") || !strings.HasSuffix(base, ".json") {
+		return ""
+	}
+	return strings.TrimSuffix(base, ".json")
+}
+
+// prepareEntry checks the JSON-encoded pgmetrics model in data, from an
+// archive or a stream of documents, and returns either the model or, in --raw
+// mode, the data to send.
+func prepareEntry(o options, data []byte) (*pgmetrics.Model, json.RawMessage, error) {
+	if o.schema {
+		if errs := api.ValidateSchema(data); len(errs) > 0 {
+			return nil, nil, fmt.Errorf("does not match the pgmetrics schema: %v (%d problems)",
+				errs[0], len(errs))
+		}
+	}
+	if len(o.expectSec) > 0 {
+		if err := api.CheckSections(data, o.expectSec); err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(o.inclSec) > 0 || len(o.exclSec) > 0 {
+		var err error
+		if data, err = api.FilterSections(data, o.inclSec, o.exclSec); err != nil {
+			return nil, nil, err
+		}
+	}
+	vo := validateOptions(o, api.PayloadPostgres)
+	if o.raw {
+		if err := api.ValidateRaw(data, vo); err != nil {
+			return nil, nil, err
+		}
+		return nil, data, nil
+	}
+	var model pgmetrics.Model
+	if err := json.Unmarshal(data, &model); err != nil {
+		return nil, nil, err
+	}
+	stripPgBouncer(o, &model, api.PayloadPostgres)
+	dropEmptyDatabases(o, &model)
+	normalizeQueries(o, &model)
+	truncateQueries(o, &model)
+	m, err := tryTransformModel(o, &model)
+	if err != nil {
+		return nil, nil, err
+	}
+	model = *m
+	adjustClock(o, &model)
+	if err := api.ValidateModel(&model, vo); err != nil {
+		if err == api.ErrHasPgBouncer {
+			err = errors.New("has PgBouncer information, use --strip-pgbouncer")
+		}
+		return nil, nil, err
+	}
+	appendUserAgent(o, &model)
+	return &model, nil, nil
+}
+
+// isZipArchive returns true if the file name starts with the signature of a
+// zip archive.
+func isZipArchive(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false // reported when opening it as a tar archive
+	}
+	defer f.Close()
+	var magic [4]byte
+	if _, err := io.ReadFull(f, magic[:]); err != nil {
+		return false
+	}
+	return bytes.Equal(magic[:], []byte("PK\x03\x04")) || bytes.Equal(magic[:], []byte("PK\x05\x06"))
+}
+
+// zipServer returns the server name for the zip entry f, like archiveServer,
+// or an empty string if it is not a pgmetrics JSON file. Gzipped files, named
+// like "db1.json.gz", are also reports, and for these gz is true. Paths with
+// backslashes, as written by some Windows tools, are handled.
+func zipServer(f *zip.File) (server string, gz bool) {
+	if !f.Mode().IsRegular() {
+		return "", false
+	}
+	base := path.Base(strings.ReplaceAll(f.Name, `\`, "/"))
+	if strings.HasPrefix(base, ".") {
+		return "", false
+	}
+	if strings.HasSuffix(base, ".json.gz") {
+		return strings.TrimSuffix(base, ".json.gz"), true
+	}
+	if strings.HasSuffix(base, ".json") {
+		return strings.TrimSuffix(base, ".json"), false
+	}
+	return "", false
+}
+
+// readZipEntry reads the zip entry f, decompressing it if gz is set.
+func readZipEntry(f *zip.File, gz bool) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if !gz {
+		return io.ReadAll(rc)
+	}
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+// archiveEntry is a file in an archive.
+type archiveEntry struct {
+	path   string // within the archive
+	server string // from the file name, empty if not a report
+	read   func() ([]byte, error)
+}
+
+// eachTarEntry calls fn for each entry of the tar archive name.
+func eachTarEntry(name string, fn func(archiveEntry)) error {
+	tr, c, err := openArchive(name)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		fn(archiveEntry{
+			path:   hdr.Name,
+			server: archiveServer(hdr),
+			read:   func() ([]byte, error) { return io.ReadAll(tr) },
+		})
+	}
+}
+
+// eachZipEntry calls fn for each entry of the zip archive name.
+func eachZipEntry(name string, fn func(archiveEntry)) error {
+	zr, err := zip.OpenReader(name)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		f := f
+		server, gz := zipServer(f)
+		fn(archiveEntry{
+			path:   f.Name,
+			server: server,
+			read:   func() ([]byte, error) { return readZipEntry(f, gz) },
+		})
+	}
+	return nil
+}
+
+// reportArchive sends a report for each pgmetrics JSON file in the tar or zip
+// archive given with --archive. Entries that are not valid reports are
+// skipped with a warning, and make pgdash exit with an error at the end.
+// API errors are fatal as usual.
+func reportArchive(o options) {
+	each := eachTarEntry
+	if isZipArchive(o.archive) {
+		each = eachZipEntry
+	}
+
+	var sent, skipped, failed int
+	err := each(o.archive, func(e archiveEntry) {
+		if len(e.server) == 0 {
+			if o.debug {
+				log.Printf("archive: skipping %s", e.path)
+			}
+			return
+		}
+		server := fullServerName(o, e.server)
+		if !api.RxServer.MatchString(server) {
+			warnf("%s: bad server name %q, skipping", e.path, server)
+			failed++
+			return
+		}
+		if o.strictCase && server != strings.ToLower(server) {
+			warnf("%s: server name %q is not in lowercase, skipping", e.path, server)
+			failed++
+			return
+		}
+		server = checkCase(o, "server", server)
+		data, err := e.read()
+		if err != nil {
+			warnf("%s: failed to read: %v, skipping", e.path, err)
+			failed++
+			return
+		}
+		if o.debug {
+			log.Printf("archive: read %s: %d bytes", e.path, len(data))
+		}
+		model, raw, err := prepareEntry(o, data)
+		if err != nil {
+			warnf("%s: invalid input: %v, skipping", e.path, err)
+			failed++
+			return
+		}
+		failure.Server = server
+		if reportServer(o, server, model, raw) {
+			sent++
+		} else {
+			skipped++
+		}
+	})
+	if err != nil {
+		fatalf("failed to read archive: %v", err)
+	}
+	failure.Server = ""
+
+	if !o.quiet {
+		fmt.Printf("archive %s sent=%d skipped=%d failed=%d\n", o.archive, sent, skipped, failed)
+	}
+	if failed > 0 {
+		fatalCode(errCodeInvalidInput, "%d of %d reports in archive could not be sent", failed, sent+skipped+failed)
+	}
+}
@@ -0,0 +1,143 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runBatch runs fn like a --watch run, so that a fatal error ends only fn,
+// and returns its standard output and log, and the exit code if it failed.
+func runBatch(t *testing.T, fn func()) (stdout, logs string, code int) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logBuf bytes.Buffer
+	oldStdout := os.Stdout
+	os.Stdout = w
+	log.SetOutput(&logBuf)
+	watching = true
+	defer func() {
+		watching = false
+		log.SetOutput(os.Stderr)
+		os.Stdout = oldStdout
+	}()
+
+	out := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		out <- string(b)
+	}()
+	func() {
+		defer func() {
+			if p := recover(); p != nil {
+				a, ok := p.(watchAbort)
+				if !ok {
+					panic(p)
+				}
+				code = a.code
+			}
+		}()
+		fn()
+	}()
+	w.Close()
+	return <-out, logBuf.String(), code
+}
+
+// gzipped returns data compressed with gzip.
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// writeZip writes a zip archive with the given files into dir, and returns
+// its path.
+func writeZip(t *testing.T, dir string, files map[string][]byte) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, data := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "reports.zip")
+	if err := os.WriteFile(name, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestReportArchive(t *testing.T) {
+	report := func(at int, replica bool) []byte {
+		return []byte(fmt.Sprintf(`{"meta":{"version":"1.17.0","at":%d},"is_in_recovery":%v}`, at, replica))
+	}
+	bad := gzipped(t, bytes.Repeat(report(2, false), 1000))
+	o := options{
+		archive: writeZip(t, t.TempDir(), map[string][]byte{
+			"db1.json":    report(1, false),
+			"db2.json.gz": bad[:len(bad)/2], // corrupt
+			"db3.json.gz": gzipped(t, report(3, false)),
+			"db4.json":    report(4, true), // skipped, not a primary
+		}),
+		dryRun:    true,
+		noTimeChk: true,
+		onlyPrim:  true,
+	}
+	stdout, logs, code := runBatch(t, func() { reportArchive(o) })
+
+	for _, want := range []string{
+		"ok server=db1 (dry run)",
+		"ok server=db3 (dry run)",
+		"sent=2 skipped=1 failed=1",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("output does not have %q:\n%s", want, stdout)
+		}
+	}
+	if strings.Contains(stdout, "server=db4") {
+		t.Errorf("replica was reported:\n%s", stdout)
+	}
+	if !strings.Contains(logs, "db2.json.gz: failed to read") {
+		t.Errorf("log does not mention the corrupt entry:\n%s", logs)
+	}
+	if code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+}
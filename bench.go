@@ -0,0 +1,185 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pborman/getopt"
+	"github.com/rapidloop/pgdash/api"
+	"github.com/rapidloop/pgmetrics"
+)
+
+// benchResult is the outcome of one report sent by the bench command.
+type benchResult struct {
+	latency time.Duration
+	conns   int    // new connections made
+	err     string // empty on success
+}
+
+// benchModel returns the model to send with the bench command: the input if
+// --input was given, otherwise a minimal synthetic report.
+func benchModel(o options) *pgmetrics.Model {
+	if len(o.input) > 0 {
+		return getReport(o, api.PayloadPostgres)
+	}
+	model := &pgmetrics.Model{
+		Metadata: pgmetrics.Metadata{
+			Version: pgmetrics.ModelSchemaVersion,
+			At:      time.Now().Unix(),
+		},
+	}
+	appendUserAgent(o, model)
+	return model
+}
+
+// percentile returns the p-th percentile of the sorted durations.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// cmdBench sends the same report repeatedly, from --concurrency workers and
+// at up to --rate reports/sec in total, for --duration, then prints the
+// latency percentiles and errors. It is not listed in the usage, and is meant
+// for load testing self-hosted pgDash. Each report is a single API call,
+// including any retries.
+func cmdBench(o options, args []string) {
+	checkAPIKey(&o)
+
+	conc, rate, dur := 4, 0, 30*time.Second
+	s := getopt.New()
+	s.SetProgram("pgdash bench")
+	s.SetUsage(printTry)
+	s.IntVarLong(&conc, "concurrency", 0, "")
+	s.IntVarLong(&rate, "rate", 0, "")
+	s.DurationVarLong(&dur, "duration", 0, "")
+	if err := s.Getopt(append([]string{"bench"}, args...), nil); err != nil {
+		fatal(err)
+	}
+	if s.NArgs() != 1 || conc < 1 || rate < 0 || dur <= 0 {
+		fatal("invalid syntax for bench command, use: bench [--concurrency=N] [--rate=N] [--duration=DURATION] SERVERNAME")
+	}
+	server := checkServer(o, s.Arg(0))
+	model := benchModel(o)
+
+	// the workers take a token for each report; with --rate, these are
+	// handed out at that rate
+	tokens := make(chan struct{})
+	done := time.After(dur)
+	go func() {
+		defer close(tokens)
+		var tick <-chan time.Time
+		if rate > 0 {
+			t := time.NewTicker(time.Second / time.Duration(rate))
+			defer t.Stop()
+			tick = t.C
+		}
+		for {
+			if tick != nil {
+				select {
+				case <-tick:
+				case <-done:
+					return
+				}
+			}
+			select {
+			case tokens <- struct{}{}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var mu sync.Mutex
+	var results []benchResult
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < conc; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := newClient(o, o.baseURL) // clients are not safe for concurrent use
+			for range tokens {
+				t := time.Now()
+				_, err := c.Report(api.ReqReport{
+					APIKey: o.apiKey,
+					Server: server,
+					Data:   *model,
+				})
+				r := benchResult{latency: time.Since(t), conns: c.LastCallStats().Conns}
+				if err != nil {
+					r.err = apiErrorMessage(err, msg400Report)
+				}
+				mu.Lock()
+				results = append(results, r)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// summarize
+	lat := make([]time.Duration, 0, len(results))
+	errs := make(map[string]int)
+	var conns int
+	for _, r := range results {
+		conns += r.conns
+		if len(r.err) > 0 {
+			errs[r.err]++
+		} else {
+			lat = append(lat, r.latency)
+		}
+	}
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	nerr := len(results) - len(lat)
+	errRate := 0.0
+	if len(results) > 0 {
+		errRate = 100 * float64(nerr) / float64(len(results))
+	}
+	fmt.Printf("bench server=%s concurrency=%d duration=%v\n", server, conc, elapsed.Round(time.Millisecond))
+	fmt.Printf("requests=%d ok=%d errors=%d (%.1f%%) rate=%.1f/sec connections=%d\n", len(results),
+		len(lat), nerr, errRate, float64(len(results))/elapsed.Seconds(), conns)
+	if len(lat) > 0 {
+		ms := func(d time.Duration) string { return fmt.Sprintf("%.1fms", float64(d)/float64(time.Millisecond)) }
+		fmt.Printf("latency p50=%s p90=%s p99=%s max=%s\n", ms(percentile(lat, 50)),
+			ms(percentile(lat, 90)), ms(percentile(lat, 99)), ms(lat[len(lat)-1]))
+	}
+	msgs := make([]string, 0, len(errs))
+	for m := range errs {
+		msgs = append(msgs, m)
+	}
+	sort.Strings(msgs)
+	for _, m := range msgs {
+		fmt.Printf("error %dx: %s\n", errs[m], m)
+	}
+	if nerr > 0 {
+		fatalf("%d of %d reports failed", nerr, len(results))
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"github.com/rapidloop/pgdash/api"
+	"github.com/rapidloop/pgmetrics"
+)
+
+// inputCache is the report read from --input in the previous run with
+// --watch, kept with --cache-input so that it need not be read and decoded
+// again if the file has not changed.
+type inputCache struct {
+	size    int64
+	mtime   time.Time
+	payload api.Payload
+	model   *pgmetrics.Model
+	raw     json.RawMessage
+}
+
+var cache *inputCache
+
+// statInput returns the size and modification time of --input if
+// --cache-input was given, or nil.
+func statInput(o options) os.FileInfo {
+	if !o.cacheInput {
+		return nil
+	}
+	fi, err := os.Stat(o.input)
+	if err != nil {
+		return nil // reading will fail with a proper error
+	}
+	return fi
+}
+
+// cachedReport returns the cached report, if the input file is unchanged
+// since it was read. A cache without a report is ignored, so that the input
+// is read again.
+func cachedReport(o options, fi os.FileInfo, payload api.Payload) (*pgmetrics.Model, json.RawMessage, bool) {
+	if fi == nil || cache == nil || cache.payload != payload ||
+		cache.size != fi.Size() || !cache.mtime.Equal(fi.ModTime()) {
+		return nil, nil, false
+	}
+	if cache.model == nil && len(cache.raw) == 0 {
+		return nil, nil, false
+	}
+	if o.debug {
+		log.Printf("input unchanged since last read, using cached report")
+	}
+	return cache.model, cache.raw, true
+}
+
+// cacheReport caches the report read from the input file, if fi is not nil.
+func cacheReport(fi os.FileInfo, payload api.Payload, model *pgmetrics.Model, raw json.RawMessage) {
+	if fi == nil {
+		return
+	}
+	cache = &inputCache{
+		size:    fi.Size(),
+		mtime:   fi.ModTime(),
+		payload: payload,
+		model:   model,
+		raw:     raw,
+	}
+}
@@ -0,0 +1,166 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/pborman/getopt"
+)
+
+// describeOption is the description of a command-line option, as output by
+// the describe command.
+type describeOption struct {
+	Long    string `json:"long"`
+	Short   string `json:"short,omitempty"`
+	Type    string `json:"type"`
+	Arg     string `json:"arg,omitempty"`
+	Default string `json:"default,omitempty"`
+	Help    string `json:"help,omitempty"`
+	Hidden  bool   `json:"hidden,omitempty"`
+}
+
+// describeCommand is the description of a command, as output by the describe
+// command. Commands with more than one form, like report, are listed once for
+// each form.
+type describeCommand struct {
+	Name string   `json:"name"`
+	Args []string `json:"args"`
+	Help string   `json:"help"`
+}
+
+type describeOutput struct {
+	Commands []describeCommand `json:"commands"`
+	Options  []describeOption  `json:"options"`
+}
+
+var (
+	rxUsageOption = regexp.MustCompile(`^  (?:-(\w), |    )--([\w-]+)(?:\[=([^\]\s]+)\]|=(\S+))?(?:\s+(.*))?$`)
+)
+
+// usageColumn is where the descriptions start in the usage text.
+const usageColumn = 27
+
+// usageHelp returns the help text for each option in the usage text, keyed by
+// the option's long name, and the list of commands. The usage text is the
+// single place where these are written down.
+func usageHelp() (opts map[string]describeOption, cmds []describeCommand) {
+	opts = make(map[string]describeOption)
+	var section, last string
+	var lastCmd = -1
+	for _, line := range strings.Split(usage, "\n") {
+		if len(line) > 0 && line[0] != ' ' {
+			section, last, lastCmd = line, "", -1
+			continue
+		}
+		cont := strings.HasPrefix(line, strings.Repeat(" ", usageColumn))
+		switch {
+		case cont && len(last) > 0:
+			o := opts[last]
+			o.Help = strings.TrimSpace(o.Help + " " + strings.TrimSpace(line))
+			opts[last] = o
+		case cont && lastCmd >= 0:
+			c := &cmds[lastCmd]
+			c.Help = strings.TrimSpace(c.Help + " " + strings.TrimSpace(line))
+		case section == "General options:":
+			m := rxUsageOption.FindStringSubmatch(line)
+			if m == nil {
+				continue
+			}
+			if _, ok := opts[m[2]]; ok {
+				last = "" // like --help=variables, already listed
+				continue
+			}
+			opts[m[2]] = describeOption{Short: m[1], Arg: m[3] + m[4], Help: m[5]}
+			last = m[2]
+		case section == "Commands:":
+			// the description is on the same line only if the usage fits
+			// before the description column
+			use, help := line, ""
+			if len(line) > usageColumn && line[usageColumn-1] == ' ' {
+				use, help = line[:usageColumn], line[usageColumn:]
+			}
+			f := strings.Fields(use)
+			if len(f) == 0 {
+				continue
+			}
+			cmds = append(cmds, describeCommand{Name: f[0], Args: f[1:], Help: help})
+			lastCmd = len(cmds) - 1
+		}
+	}
+	return
+}
+
+// optionType returns the type of value an option takes, like "uint".
+func optionType(opt getopt.Option) string {
+	if opt.IsFlag() {
+		return "bool"
+	}
+	t := reflect.TypeOf(opt.Value())
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch name := strings.TrimSuffix(t.Name(), "Value"); name {
+	case "float64":
+		return "float"
+	default:
+		return name
+	}
+}
+
+// cmdDescribe outputs the commands and options as JSON. It is not listed in
+// the usage, and is meant for tools that wrap pgdash.
+func cmdDescribe(o options, args []string) {
+	if len(args) > 1 || (len(args) == 1 && args[0] != "--format=json") {
+		fatal("invalid syntax for describe command, only --format=json is supported.")
+	}
+
+	var d options
+	d.defaults()
+	s := d.optionSet()
+	help, cmds := usageHelp()
+	out := describeOutput{Commands: cmds}
+	s.VisitAll(func(opt getopt.Option) {
+		// Name is like "--input", or "-i" for options with a short name
+		long := strings.TrimPrefix(opt.Name(), "--")
+		if strings.HasPrefix(long, "-") {
+			for k, v := range help {
+				if "-"+v.Short == long {
+					long = k
+				}
+			}
+		}
+		do, ok := help[long]
+		do.Long = long
+		do.Type = optionType(opt)
+		do.Hidden = !ok
+		if !opt.IsFlag() {
+			do.Default = opt.String()
+		}
+		out.Options = append(out.Options, do)
+	})
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(out); err != nil {
+		fatalf("failed to write output: %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/rapidloop/pgdash/api"
+)
+
+// destination is an additional pgDash account to send reports to, given
+// with --destination=APIKEY[@URL].
+type destination struct {
+	apiKey  string
+	baseURL string
+	client  *api.RestV1Client
+}
+
+// parseDestination parses the value of a --destination option. The base URL
+// defaults to the one given with --base-url.
+func parseDestination(o options, s string) (d destination, err error) {
+	d.apiKey, d.baseURL = s, o.baseURL
+	if i := strings.IndexByte(s, '@'); i >= 0 {
+		d.apiKey = s[:i]
+		if d.baseURL, err = checkBaseURL(s[i+1:], o.apiVersion); err != nil {
+			return
+		}
+	}
+	if !api.RxAPIKey.MatchString(d.apiKey) {
+		err = fmt.Errorf("invalid API key format in destination '%s'", s)
+	}
+	return
+}
+
+// redactURL returns s with any password in it replaced by "xxxxx".
+func redactURL(s string) string {
+	if u, err := url.Parse(s); err == nil {
+		return u.Redacted()
+	}
+	return s
+}
+
+// destsError is returned by trySendAll if sending to any of multiple
+// destinations failed. The failures have been logged already.
+type destsError struct {
+	failed, total int
+}
+
+func (e *destsError) Error() string {
+	return fmt.Sprintf("report failed for %d of %d destinations", e.failed, e.total)
+}
+
+// sendAll calls send with the client and API key of each destination, the
+// first one being from -a and --base-url, and prints a summary line for each.
+// Each destination has its own retries. With only one destination, errors
+// are handled as usual by checkAPIError. Otherwise, every destination is tried
+// before exiting with an error if any of them failed. With --dry-run, nothing
+// is sent. at is the time the report was collected, for --only-if-newer, and
+// hash is from payloadHash, for --dedupe-window. It returns false if the
+// report was skipped because of these.
+func sendAll(o options, msg400 string, at int64, hash string, send func(c *api.RestV1Client, apiKey string) error, names ...string) bool {
+	sent, err := trySendAll(o, msg400, at, hash, send, names...)
+	checkSendError(err, msg400)
+	return sent
+}
+
+// checkSendError exits with a suitable message and exit code if err, returned
+// from trySendAll, is not nil.
+func checkSendError(err error, msg400 string) {
+	if e, ok := err.(*destsError); ok {
+		fatal(e)
+	}
+	checkAPIError(err, msg400)
+}
+
+// trySendAll is like sendAll, but returns the error instead of exiting.
+func trySendAll(o options, msg400 string, at int64, hash string, send func(c *api.RestV1Client, apiKey string) error, names ...string) (bool, error) {
+	key := strings.Join(names, " ")
+	if !isNewer(o, key, at) || isDuplicate(o, key, hash) {
+		return false, nil
+	}
+	if o.dryRun {
+		r := jsonResult{OK: true, Command: failure.Command, DryRun: true}
+		r.setNames(names)
+		appendSummary(r)
+		if !o.quiet && outputJSON {
+			printJSON(r)
+		} else if !o.quiet {
+			fmt.Printf("ok %s (dry run)\n", strings.Join(names, " "))
+		}
+		return true, nil
+	}
+	if len(o.dests) == 0 {
+		if err := send(client, o.apiKey); err != nil {
+			return false, err
+		}
+		printSummary(o, client.LastCallStats(), names...)
+		recordSent(o, key, at, hash)
+		runSuccessHook(o, client.LastCallStats(), names...)
+		return true, nil
+	}
+
+	dests := append([]destination{{apiKey: o.apiKey, baseURL: o.baseURL, client: client}}, o.dests...)
+	var failed int
+	var total api.CallStats
+	for i, d := range dests {
+		label := fmt.Sprintf("dest=%d", i+1)
+		if err := send(d.client, d.apiKey); err != nil {
+			failure.code, failure.status = apiErrorCode(err)
+			msg := apiErrorMessage(err, msg400)
+			log.Printf("%s (%s): %s", label, redactURL(d.baseURL), msg)
+			failed++
+			continue
+		}
+		s := d.client.LastCallStats()
+		printSummary(o, s, append([]string{label}, names...)...)
+		total.Attempts += s.Attempts
+		total.Bytes += s.Bytes
+		total.Duration += s.Duration
+	}
+	if failed > 0 {
+		return false, &destsError{failed: failed, total: len(dests)}
+	}
+	recordSent(o, key, at, hash)
+	runSuccessHook(o, total, names...)
+	return true, nil
+}
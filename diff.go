@@ -0,0 +1,205 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rapidloop/pgdash/api"
+	"github.com/rapidloop/pgmetrics"
+)
+
+// loadModel reads, decodes and validates the pgmetrics model in the named
+// file, which may contain any kind of information.
+func loadModel(o options, name string) *pgmetrics.Model {
+	data, err := readFile(name)
+	if err != nil {
+		fatalf("failed to read input: %v", err)
+	}
+	model := decodeModel(o, data)
+	validateModel(o, model, api.PayloadAny)
+	return model
+}
+
+// fmtBytes returns a human-readable form of a size in bytes.
+func fmtBytes(n int64) string {
+	if n < 0 {
+		return "n/a"
+	}
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// fmtDelta returns the difference between two values with a sign, or an empty
+// string if they are the same.
+func fmtDelta(a, b int64, f func(int64) string) string {
+	switch {
+	case b > a:
+		return " (+" + f(b-a) + ")"
+	case b < a:
+		return " (-" + f(a-b) + ")"
+	}
+	return ""
+}
+
+func fmtInt(n int64) string {
+	return fmt.Sprint(n)
+}
+
+func cmdDiff(o options, args []string) {
+	if len(args) != 2 {
+		fatal("invalid syntax for diff command, try --help for help.")
+	}
+	m1 := loadModel(o, args[0])
+	m2 := loadModel(o, args[1])
+
+	// collection time
+	at1, at2 := time.Unix(m1.Metadata.At, 0), time.Unix(m2.Metadata.At, 0)
+	fmt.Printf("collected at:     %s -> %s (%v)\n", at1.Format(time.RFC3339),
+		at2.Format(time.RFC3339), at2.Sub(at1))
+
+	// connections
+	c1, c2 := int64(len(m1.Backends)), int64(len(m2.Backends))
+	fmt.Printf("connections:      %d -> %d%s\n", c1, c2, fmtDelta(c1, c2, fmtInt))
+
+	diffDatabases(m1, m2)
+	diffReplication(m1, m2)
+	diffStatements(m1, m2)
+}
+
+func diffDatabases(m1, m2 *pgmetrics.Model) {
+	sizes1 := make(map[string]int64)
+	for _, d := range m1.Databases {
+		sizes1[d.Name] = d.Size
+	}
+	seen := make(map[string]bool)
+	fmt.Println("database sizes:")
+	for _, d := range m2.Databases {
+		seen[d.Name] = true
+		if s1, ok := sizes1[d.Name]; !ok {
+			fmt.Printf("  %-30s (new) -> %s\n", d.Name, fmtBytes(d.Size))
+		} else if s1 >= 0 && d.Size >= 0 {
+			fmt.Printf("  %-30s %s -> %s%s\n", d.Name, fmtBytes(s1),
+				fmtBytes(d.Size), fmtDelta(s1, d.Size, fmtBytes))
+		} else {
+			fmt.Printf("  %-30s %s -> %s\n", d.Name, fmtBytes(s1), fmtBytes(d.Size))
+		}
+	}
+	for _, d := range m1.Databases {
+		if !seen[d.Name] {
+			fmt.Printf("  %-30s %s -> (dropped)\n", d.Name, fmtBytes(d.Size))
+		}
+	}
+}
+
+func diffReplication(m1, m2 *pgmetrics.Model) {
+	if len(m1.ReplicationOutgoing) == 0 && len(m2.ReplicationOutgoing) == 0 {
+		return
+	}
+	key := func(r pgmetrics.ReplicationOut) string {
+		if len(r.ApplicationName) > 0 {
+			return r.ApplicationName
+		}
+		return r.ClientAddr
+	}
+	lag1 := make(map[string]int64)
+	for _, r := range m1.ReplicationOutgoing {
+		lag1[key(r)] = int64(r.ReplayLag)
+	}
+	seen := make(map[string]bool)
+	fmt.Println("replication replay lag (seconds):")
+	for _, r := range m2.ReplicationOutgoing {
+		k, l2 := key(r), int64(r.ReplayLag)
+		seen[k] = true
+		if l1, ok := lag1[k]; ok {
+			fmt.Printf("  %-30s %d -> %d%s\n", k, l1, l2, fmtDelta(l1, l2, fmtInt))
+		} else {
+			fmt.Printf("  %-30s (new) -> %d\n", k, l2)
+		}
+	}
+	for _, r := range m1.ReplicationOutgoing {
+		if k := key(r); !seen[k] {
+			fmt.Printf("  %-30s %d -> (gone)\n", k, lag1[k])
+		}
+	}
+}
+
+// topStatements is the number of statements listed by diff and stats.
+const topStatements = 5
+
+func diffStatements(m1, m2 *pgmetrics.Model) {
+	if len(m2.Statements) == 0 {
+		return
+	}
+	key := func(s pgmetrics.Statement) string {
+		return fmt.Sprintf("%s/%s/%d", s.DBName, s.UserName, s.QueryID)
+	}
+	old := make(map[string]pgmetrics.Statement)
+	for _, s := range m1.Statements {
+		old[key(s)] = s
+	}
+
+	// the counters are cumulative, so compute how much each statement
+	// contributed between the two collections
+	type delta struct {
+		s     pgmetrics.Statement
+		calls int64
+		time  float64
+	}
+	deltas := make([]delta, 0, len(m2.Statements))
+	for _, s := range m2.Statements {
+		d := delta{s: s, calls: s.Calls, time: s.TotalTime}
+		if p, ok := old[key(s)]; ok && p.Calls <= s.Calls {
+			d.calls -= p.Calls
+			d.time -= p.TotalTime
+		}
+		if d.calls > 0 {
+			deltas = append(deltas, d)
+		}
+	}
+	sort.Slice(deltas, func(i, j int) bool { return deltas[i].time > deltas[j].time })
+	if len(deltas) > topStatements {
+		deltas = deltas[:topStatements]
+	}
+
+	fmt.Println("top statements by total time between collections:")
+	for _, d := range deltas {
+		fmt.Printf("  %10.1f ms %8d calls  %s: %s\n", d.time, d.calls, d.s.DBName,
+			truncQuery(d.s.Query))
+	}
+}
+
+// truncQuery returns the query text in a single line, truncated for display.
+func truncQuery(q string) string {
+	const max = 60
+	r := []rune(strings.Join(strings.Fields(q), " "))
+	if len(r) > max {
+		return string(r[:max-3]) + "..."
+	}
+	return string(r)
+}
@@ -0,0 +1,159 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rapidloop/pgdash/api"
+	"github.com/rapidloop/pgmetrics"
+)
+
+// echoAddr is the default address for the echo-server command.
+const echoAddr = "localhost:8080"
+
+// echoRequest has the fields of all the report requests, with the model left
+// encoded so that it is printed as received.
+type echoRequest struct {
+	APIKey    string          `json:"apikey"`
+	Server    string          `json:"server"`
+	PgBouncer string          `json:"pgbouncer"`
+	Pgpool    string          `json:"pgpool"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// echoHandler returns the handler for the report API endpoints, which checks
+// each request like pgDash would and prints a summary of it.
+func echoHandler() http.Handler {
+	mux := http.NewServeMux()
+	for _, path := range []string{"report", "reportpgbouncer", "reportpgpool"} {
+		path := path
+		mux.HandleFunc("/api/v1/"+path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "POST" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			var body io.Reader = r.Body
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				zr, err := gzip.NewReader(r.Body)
+				if err != nil {
+					echoReject(w, path, err.Error())
+					return
+				}
+				body = zr
+			}
+			var req echoRequest
+			if err := json.NewDecoder(body).Decode(&req); err != nil {
+				echoReject(w, path, err.Error())
+				return
+			}
+			if msg := checkEcho(path, req); len(msg) > 0 {
+				echoReject(w, path, msg)
+				return
+			}
+			printEcho(path, req)
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, "{}\n")
+		})
+	}
+	return mux
+}
+
+// checkEcho returns why the request to the endpoint path is not acceptable,
+// or an empty string if it is.
+func checkEcho(path string, req echoRequest) string {
+	if !api.RxAPIKey.MatchString(req.APIKey) {
+		return "invalid API key format"
+	}
+	names := map[string]string{"server": req.Server}
+	payload := api.PayloadPostgres
+	switch path {
+	case "reportpgbouncer":
+		names["pgbouncer"] = req.PgBouncer
+		payload = api.PayloadPgBouncer
+	case "reportpgpool":
+		names = map[string]string{"pgpool": req.Pgpool}
+		payload = api.PayloadPgpool
+	}
+	for k, v := range names {
+		if !api.RxServer.MatchString(v) {
+			return fmt.Sprintf("invalid %s name %q", k, v)
+		}
+	}
+	vo := api.DefaultValidateOptions()
+	vo.Payload = payload
+	if err := api.ValidateRaw(req.Data, vo); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// echoReject logs why a request was rejected and responds with HTTP 400,
+// like pgDash does.
+func echoReject(w http.ResponseWriter, path, msg string) {
+	fmt.Printf("rejected %s: %s\n", path, msg)
+	http.Error(w, msg, http.StatusBadRequest)
+}
+
+// printEcho prints a summary line for an accepted request.
+func printEcho(path string, req echoRequest) {
+	var peek struct {
+		Metadata pgmetrics.Metadata `json:"meta"`
+	}
+	json.Unmarshal(req.Data, &peek) // already validated
+	var b strings.Builder
+	fmt.Fprintf(&b, "received %s", path)
+	if len(req.Pgpool) > 0 {
+		fmt.Fprintf(&b, " pgpool=%s", req.Pgpool)
+	} else {
+		fmt.Fprintf(&b, " server=%s", req.Server)
+	}
+	if len(req.PgBouncer) > 0 {
+		fmt.Fprintf(&b, " pgbouncer=%s", req.PgBouncer)
+	}
+	fmt.Fprintf(&b, " apikey=%s... bytes=%d version=%s at=%s", req.APIKey[:4], len(req.Data),
+		peek.Metadata.Version, time.Unix(peek.Metadata.At, 0).UTC().Format(time.RFC3339))
+	fmt.Println(b.String())
+}
+
+// cmdEchoServer runs an HTTP server at ADDR (default: localhost:8080) that
+// accepts reports like pgDash, and prints a line for each one received,
+// without storing them. It is not listed in the usage, and is meant for
+// testing and demos, with --base-url=http://ADDR.
+func cmdEchoServer(o options, args []string) {
+	if len(args) > 1 {
+		fatal("invalid syntax for echo-server command, use: echo-server [ADDR]")
+	}
+	addr := echoAddr
+	if len(args) == 1 {
+		addr = args[0]
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           echoHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	log.Printf("listening on %s, use --base-url=http://%s", addr, addr)
+	fatal(srv.ListenAndServe())
+}
@@ -0,0 +1,178 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/rapidloop/pgdash/api"
+	"github.com/rapidloop/pgmetrics"
+)
+
+// maxExecStderr is the most output from the stderr of an --exec or
+// --transform command that is logged.
+const maxExecStderr = 4096
+
+// defaultTransformTimeout is the default for --transform-timeout.
+const defaultTransformTimeout = time.Minute
+
+// execInput runs the command given with --exec, and returns its stdout as the
+// input. The command is killed if it runs longer than --exec-timeout, which
+// defaults to the --watch interval.
+func execInput(o options) []byte {
+	tout := o.execTout
+	if tout == 0 {
+		tout = o.watch
+	}
+	return runShell(o, "exec", o.exec, nil, tout)
+}
+
+// transformModel runs the command given with --transform, with the
+// JSON-encoded model as its input, and returns the model it outputs. The
+// command is killed if it runs longer than --transform-timeout. It exits if
+// the command fails, see tryTransformModel.
+func transformModel(o options, model *pgmetrics.Model) *pgmetrics.Model {
+	m, err := tryTransformModel(o, model)
+	if err != nil {
+		fatalCode(errCodeInvalidInput, "%v", err)
+	}
+	return m
+}
+
+// tryTransformModel is like transformModel, but returns an error if the
+// command fails or its output is not a valid model.
+func tryTransformModel(o options, model *pgmetrics.Model) (*pgmetrics.Model, error) {
+	if len(o.transform) == 0 {
+		return model, nil
+	}
+	in, err := json.Marshal(model)
+	if err != nil {
+		return nil, fmt.Errorf("transform: failed to encode model: %v", err)
+	}
+	out, err := tryShell(o, "transform", o.transform, in, nil, o.transTout)
+	if err != nil {
+		return nil, fmt.Errorf("transform: %v", err)
+	}
+	var m pgmetrics.Model
+	if err := json.Unmarshal(out, &m); err != nil {
+		return nil, fmt.Errorf("transform: invalid output from command: %v", err)
+	}
+	return &m, nil
+}
+
+// runShell runs the command line with the shell, feeding it stdin, and returns
+// its stdout. It exits if the command fails, see tryShell.
+func runShell(o options, what, line string, stdin []byte, tout time.Duration) []byte {
+	out, err := tryShell(o, what, line, stdin, nil, tout)
+	if err != nil {
+		fatalCode(errCodeInvalidInput, "%s: %v", what, err)
+	}
+	return out
+}
+
+// tryShell runs the command line with the shell, feeding it stdin, with env
+// added to its environment, and returns its stdout. The command is killed if
+// it runs longer than tout, if not 0. Its stderr is logged if it fails, or
+// with --debug. Messages are prefixed by what, the option that gave the
+// command.
+func tryShell(o options, what, line string, stdin []byte, env []string, tout time.Duration) ([]byte, error) {
+	ctx := context.Background()
+	if tout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, tout)
+		defer cancel()
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := shellCommand(ctx, line)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	if env != nil {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = time.Second // don't wait for children holding the pipes
+	t := time.Now()
+	err := cmd.Run()
+	if err != nil || o.debug {
+		logExecStderr(what, stderr.Bytes())
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("command did not finish within %v, killed", tout)
+	} else if err != nil {
+		return nil, fmt.Errorf("command failed: %v", err)
+	}
+	if o.debug {
+		log.Printf("%s: command finished in %v, %d bytes of output", what,
+			time.Since(t).Round(time.Millisecond), stdout.Len())
+	}
+	return stdout.Bytes(), nil
+}
+
+// hookTimeout is how long the --after-success-command may run.
+const hookTimeout = time.Minute
+
+// runSuccessHook runs the --after-success-command, if given, for a report
+// sent under names (like "server=NAME") as per the call stats s. The names
+// and stats are passed in environment variables like PGDASH_SERVER and
+// PGDASH_BYTES. If the command fails, a warning is logged, or with
+// --strict-hooks, pgdash exits with an error.
+func runSuccessHook(o options, s api.CallStats, names ...string) {
+	if len(o.afterCmd) == 0 {
+		return
+	}
+	env := []string{
+		fmt.Sprintf("PGDASH_DURATION_MS=%d", s.Duration.Milliseconds()),
+		fmt.Sprintf("PGDASH_BYTES=%d", s.Bytes),
+		fmt.Sprintf("PGDASH_ATTEMPTS=%d", s.Attempts),
+	}
+	for _, n := range names {
+		if k, v, ok := strings.Cut(n, "="); ok {
+			env = append(env, "PGDASH_"+strings.ToUpper(k)+"="+v)
+		}
+	}
+	if _, err := tryShell(o, "after-success-command", o.afterCmd, nil, env, hookTimeout); err != nil {
+		if o.strictHook {
+			fatalf("after-success-command: %v", err)
+		}
+		warnf("after-success-command: %v", err)
+	}
+}
+
+// logExecStderr logs the stderr output of an --exec or --transform command,
+// line by line.
+func logExecStderr(what string, b []byte) {
+	if len(b) > maxExecStderr {
+		b = b[len(b)-maxExecStderr:]
+		log.Printf("%s: stderr: ...", what)
+	}
+	for _, line := range strings.Split(strings.TrimRight(string(b), "\n"), "\n") {
+		if len(line) > 0 {
+			log.Printf("%s: stderr: %s", what, line)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// readyIntervals is the number of --watch intervals within which the last run
+// must have succeeded for /readyz to report ready.
+const readyIntervals = 3
+
+// lastSuccess is the time of the last successful run with --watch, as
+// returned by time.Time.UnixNano, or 0 if none yet.
+var lastSuccess atomic.Int64
+
+// healthHandler serves /healthz, which is always ok, /readyz, which is ok
+// only if the last successful run with --watch was recent, and /metrics, with
+// the counts of runs.
+func healthHandler(o options) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		last := lastSuccess.Load()
+		if last == 0 {
+			http.Error(w, "no successful run yet", http.StatusServiceUnavailable)
+			return
+		}
+		if ago := time.Since(time.Unix(0, last)); ago > readyIntervals*o.watch {
+			http.Error(w, fmt.Sprintf("last successful run was %v ago",
+				ago.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	return mux
+}
+
+// startHealthServer starts the HTTP server for --health-endpoint. On SIGTERM
+// or SIGINT, the server is shut down and pgdash exits.
+func startHealthServer(o options) {
+	ln, err := net.Listen("tcp", o.healthAddr)
+	if err != nil {
+		fatalf("failed to start health endpoint: %v", err)
+	}
+	srv := &http.Server{
+		Handler:           healthHandler(o),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("warning: health endpoint failed: %v", err)
+		}
+	}()
+	if o.debug {
+		log.Printf("health endpoint listening on %s", ln.Addr())
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		s := <-sig
+		log.Printf("received %v, exiting", s)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+		os.Exit(0)
+	}()
+}
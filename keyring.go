@@ -0,0 +1,65 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+
+	"github.com/rapidloop/pgdash/api"
+)
+
+// keyringService is the service name under which API keys are stored in the
+// system keyring.
+const keyringService = "pgdash"
+
+// errKeyNotFound is returned by keyringGet and keyringDelete if there is no
+// API key stored for the account.
+var errKeyNotFound = errors.New("no API key found in the system keyring")
+
+func cmdSetKey(o options, args []string) {
+	if len(args) != 1 {
+		fatal("invalid syntax for set-key command, try --help for help.")
+	}
+
+	// get the key from -a or PDAPIKEY, else from stdin
+	key := o.apiKey
+	if len(key) == 0 {
+		data, err := readAll(os.Stdin)
+		if err != nil {
+			fatalf("failed to read API key from stdin: %v", err)
+		}
+		key = strings.TrimSpace(string(data))
+	}
+	if !api.RxAPIKey.MatchString(key) {
+		fatal("invalid API key format")
+	}
+
+	if err := keyringSet(args[0], key); err != nil {
+		fatalf("failed to store API key: %v", err)
+	}
+}
+
+func cmdDeleteKey(o options, args []string) {
+	if len(args) != 1 {
+		fatal("invalid syntax for delete-key command, try --help for help.")
+	}
+	if err := keyringDelete(args[0]); err != nil {
+		fatalf("failed to delete API key: %v", err)
+	}
+}
@@ -0,0 +1,73 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The macOS Keychain is accessed using the security(1) tool. The API key is
+// never passed as an argument, where other local users could see it with ps,
+// but in a command written to "security -i" on its stdin.
+
+func security(stdin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("security", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	var ee *exec.ExitError
+	if err != nil && !errors.As(err, &ee) {
+		return "", fmt.Errorf("no keyring backend available: %v", err)
+	}
+	// in interactive mode, failed commands do not change the exit status
+	if err != nil || (len(stdin) > 0 && stderr.Len() > 0) {
+		if strings.Contains(stderr.String(), "could not be found") {
+			return "", errKeyNotFound
+		}
+		return "", fmt.Errorf("security: %s", strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// securityQuote quotes s as a single argument for a "security -i" command.
+func securityQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
+
+func keyringGet(account string) (string, error) {
+	return security("", "find-generic-password", "-s", keyringService, "-a", account, "-w")
+}
+
+func keyringSet(account, key string) error {
+	if strings.ContainsAny(key+account, "\r\n") {
+		return errors.New("API key and account cannot contain line breaks")
+	}
+	_, err := security(fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n",
+		securityQuote(keyringService), securityQuote(account), securityQuote(key)), "-i")
+	return err
+}
+
+func keyringDelete(account string) error {
+	_, err := security("", "delete-generic-password", "-s", keyringService, "-a", account)
+	return err
+}
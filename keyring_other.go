@@ -0,0 +1,68 @@
+//go:build !darwin && !windows
+
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The Secret Service (GNOME Keyring, KWallet etc.) is accessed using the
+// secret-tool(1) command, from the libsecret-tools package.
+
+func secretTool(stdin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("secret-tool", args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		var ee *exec.ExitError
+		if errors.As(err, &ee) {
+			if stderr.Len() == 0 && stdout.Len() == 0 {
+				return "", errKeyNotFound
+			}
+			return "", fmt.Errorf("secret-tool: %s", strings.TrimSpace(stderr.String()))
+		}
+		return "", fmt.Errorf("no keyring backend available (is secret-tool installed?): %v", err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func keyringGet(account string) (string, error) {
+	return secretTool("", "lookup", "service", keyringService, "account", account)
+}
+
+func keyringSet(account, key string) error {
+	_, err := secretTool(key, "store", "--label=pgdash API key ("+account+")",
+		"service", keyringService, "account", account)
+	return err
+}
+
+func keyringDelete(account string) error {
+	// secret-tool clear does not report if nothing was found
+	if _, err := keyringGet(account); err != nil {
+		return err
+	}
+	_, err := secretTool("", "clear", "service", keyringService, "account", account)
+	return err
+}
@@ -0,0 +1,63 @@
+//go:build windows
+
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockHandle is the handle of the lock file, kept open till the process exits.
+var lockHandle syscall.Handle
+
+const errorSharingViolation syscall.Errno = 32
+
+// lockFile takes an exclusive lock on the named file, creating it if needed,
+// by opening it without allowing any sharing. The lock is held until the
+// process exits. If another process holds the lock, errLocked is returned.
+func lockFile(name string) error {
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+	if err == errorSharingViolation {
+		return errLocked
+	} else if err != nil {
+		return err
+	}
+	lockHandle = h
+	return nil
+}
+
+// appendLocked appends data to the named file, creating it if needed. On
+// Windows, each write to a file opened for appending is atomic, so
+// concurrent appends are not interleaved.
+func appendLocked(name string, data []byte) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
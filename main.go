@@ -17,12 +17,21 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"math/rand"
+	"net"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/rapidloop/pgdash/api"
@@ -35,24 +44,279 @@ const usage = `pgdash is a command-line tool for talking to the pgDash applicati
 
 Usage:
   pgdash [OPTION]... COMMAND [ARGS]...
+  pgdash [OPTION]... --connect-only
 
 General options:
       --timeout=SECS       individual operation timeout in seconds (default: 60)
+      --report-timeout=SECS
+                           timeout for the report command (default: --timeout)
+      --report-pgbouncer-timeout=SECS
+                           timeout for report-pgbouncer (default: --timeout)
+      --report-pgpool-timeout=SECS
+                           timeout for report-pgpool (default: --timeout)
       --retries=COUNT      retry these many times on network or server errors (default: 5)
-  -i, --input=FILE         read from this JSON file instead of stdin
+      --retry-on-timeout=false
+                           fail right away if an attempt times out, instead
+                               of retrying
+      --retry-after-min=DURATION
+                           wait at least this long when the server asks to
+                               retry after some time (default: 1s)
+      --retry-after-max=DURATION
+                           wait at most this long when the server asks to
+                               retry after some time (default: 5m)
+      --min-throughput=BPS raise the timeout for large reports so that they
+                               can be sent at BPS bytes/sec (default: 0, off)
+      --stream             compress the report while sending it, rather than
+                               before; --min-throughput does not apply
+  -i, --input=FILE         read from this JSON file instead of stdin ("-" for
+                               stdin)
   -a, --api-key=APIKEY     the API key for your pgDash account
-      --base-url=URL       for use with self-hosted version of pgDash, see docs
+      --keyring=ACCOUNT    read the API key stored with set-key from the
+                               system keyring
+      --vault-path=PATH[#FIELD]
+                           read the API key from FIELD (default: api_key) of
+                               the HashiCorp Vault KV secret at PATH, like
+                               "secret/data/pgdash"; needs a build with
+                               "-tags vault"
+      --base-url=URL       for use with self-hosted version of pgDash, see docs;
+                               use file:///DIR to write requests into DIR, or
+                               unix:///PATH[?path=/PREFIX] to connect to the
+                               Unix socket PATH
+      --prefer=FAMILY      connect to the IPv4 ("ipv4") or IPv6 ("ipv6")
+                               addresses of the server first, for networks
+                               where the other does not work
+      --no-proxy=HOSTS     connect to these comma-separated hosts, domains,
+                               IP addresses or CIDR blocks directly, instead
+                               of through the proxy from HTTPS_PROXY; in
+                               addition to those in NO_PROXY
+      --http-user=USER     send USER and the password from --http-password (or
+                               PDHTTPPASSWORD) using HTTP basic auth, for
+                               servers behind a proxy that requires it; these
+                               can also be given in the base URL
+      --http-password=PASS password for --http-user
+      --no-follow-redirects
+                           fail if the server responds with an HTTP redirect,
+                               instead of sending the report again to the
+                               new location
+      --signing-key=KEY    send the HMAC-SHA256 of each request body, signed
+                               with KEY (or PDSIGNINGKEY), as a hex string in
+                               an HTTP header, for servers behind an ingress
+                               that checks it; cannot be used with --stream
+      --signing-header=NAME
+                           send the signature in the header NAME (default:
+                               X-PgDash-Signature)
+      --content-md5        send the MD5 digest of each request body in the
+                               Content-MD5 header, for servers that check
+                               it; cannot be used with --stream
+      --api-version=VER    version of the pgDash API to use (default: v1)
+      --expand-env         expand $VAR and ${VAR} in --base-url, --input,
+                               --archive, --dump-on-error, --state-dir,
+                               --summary-file and --lock-file
+      --max-response-size=BYTES
+                           fail if server response is larger (default: 4194304)
+      --server-prefix=STR  prepend STR to SERVERNAME, like "prod-"
+      --server-suffix=STR  append STR to SERVERNAME, like "-shard1"; "{year}",
+                               "{month}", "{date}" and "{hour}" in STR are
+                               replaced with the current UTC time, like
+                               "2023", "202311", "20231114" and "2023111422"
+      --server-name-from-hostname
+                           for report, use the hostname of this machine as the
+                               SERVERNAME
+      --short-hostname     with --server-name-from-hostname, use only the part
+                               of the hostname before the first "."
+      --server-template=TEMPLATE
+                           for report, use the Go template TEMPLATE, applied to
+                               the input, as the SERVERNAME; like
+                               "{{.Metadata.Username}}-{{.SystemIdentifier}}"
+      --truncate-query-length=N
+                           cut the text of each query in the report to N
+                               characters, followed by "..."
+      --normalize-whitespace-queries
+                           collapse runs of whitespace in the text of each
+                               query in the report to a single space, except
+                               in quoted strings and comments
+      --drop-empty-databases
+                           do not send databases whose activity counters are
+                               all zero, or their tables, indexes and other
+                               objects, see README.md
+      --lowercase-server   convert server, PgBouncer and Pgpool names to
+                               lowercase, so that "Prod01" and "prod01" are
+                               the same server
+      --strict-case        fail if a server, PgBouncer or Pgpool name is not
+                               in lowercase
+      --strip-pgbouncer    for report, drop any PgBouncer information from the
+                               input instead of failing
+      --with-pgbouncer=PGBOUNCERNAME
+                           for report, also send the PgBouncer information in
+                               the input as the report for PGBOUNCERNAME, like
+                               report-pgbouncer does
+      --strict             treat likely mistakes in arguments as errors
+      --fail-on-warnings   exit with an error if any warnings were logged, after
+                               completing the command
+      --sample-rate=RATE   send reports only with this probability, from 0.0 to
+                               1.0, exiting successfully otherwise (default: 1.0)
+      --multi              allow report to send the same report under each of
+                               multiple SERVERNAMEs, stopping at the first failure
+      --no-user-agent-append
+                           do not add pgdash/VERSION to the user agent in the
+                               report metadata
+      --schema-validate    check the input against the structure of the pgmetrics
+                               model, including for unknown fields
+      --archive=FILE       for report, send each *.json file in the tar archive
+                               FILE (optionally gzipped), or in the zip archive
+                               FILE (where *.json.gz files are also sent), as
+                               a report, with the file name (without .json)
+                               as the SERVERNAME
+      --abort-on-schema-mismatch
+                           fail if the major version of the pgmetrics schema
+                               of the input is not supported, instead of
+                               warning and sending it anyway
+      --no-time-check      do not check that the input was collected within
+                               180 days of now, for replaying old reports or
+                               testing; UNSAFE for production use
+      --clock-offset=DURATION
+                           add DURATION, like "90s" or "-2h", to the collection
+                               time of the input before checking and sending
+                               it, for hosts with a clock that is known to be
+                               off; cannot be used with --raw
+      --multi-doc          for report, send each of the pgmetrics JSON
+                               documents in the input, one after the other,
+                               as a report under SERVERNAME if given, or else
+                               under the hostname in the document
+      --raw                send the input as-is, checking only its metadata,
+                               to keep fields unknown to pgdash
+      --watch=DURATION     for report commands, send a report every DURATION
+                               (like "5m") until killed, reading --input or
+                               --archive, or running --exec, each time
+      --exec=COMMAND       run COMMAND (like "pgmetrics -f json mydb") with
+                               the shell, and use its output as the input
+      --exec-timeout=DURATION
+                           kill the --exec command if it runs longer than
+                               DURATION (default: the --watch interval)
+      --transform=COMMAND  run COMMAND (like "jq 'del(.plans)'") with the
+                               shell, with the report as JSON on its stdin,
+                               and send the report it writes to stdout
+      --transform-timeout=DURATION
+                           kill the --transform command if it runs longer
+                               than DURATION (default: 1m)
+      --health-endpoint=ADDR
+                           with --watch, serve /healthz (always ok), /readyz
+                               (ok if a report was sent successfully within
+                               the last 3 intervals) and /metrics (counts of
+                               runs, failures and retries, for Prometheus)
+                               over HTTP at ADDR, like ":8080"
+      --report-interval-metrics=DURATION
+                           with --watch, log the counts of runs and failures,
+                               the last success time, the average run time
+                               and the retry state of the API calls every
+                               DURATION
+      --cache-input        with --watch, do not read and check --input again
+                               if its size and modification time are the same
+                               as when it was last read
+      --jitter=DURATION    with --watch, delay the first report by a random
+                               duration up to DURATION
+      --jitter-each        with --jitter, also delay each later report
+      --jitter-seed=STR    use STR (like the hostname) to seed the random
+                               delays, so that they are the same each time
+      --connect-only       only connect to the base URL host (and complete the
+                               TLS handshake), report the time taken, then exit
+      --wait-for-network=DURATION
+                           before sending the first report, wait up to
+                               DURATION for a connection to the base URL host
+                               to succeed, for use early during boot
+      --destination=APIKEY[@URL]
+                           also send reports to the pgDash account with this
+                               API key, at URL (default: --base-url); can be
+                               repeated
+      --expect-section=NAME
+                           fail if the section NAME of the input, like
+                               "statements" or "replication", is missing or
+                               empty; can be repeated
+      --exit-zero-on-empty if the input is empty, or has nothing but metadata,
+                               skip the report and exit with status 0,
+                               instead of failing
+      --include-sections=LIST
+                           send only these comma-separated sections of the
+                               input, and the metadata; see list-sections
+      --exclude-sections=LIST
+                           do not send these comma-separated sections of the
+                               input, like "statements,plans"
+      --state-dir=DIR      keep the state needed by options like
+                               --only-if-newer in DIR, see README.md
+      --compress-state     gzip the state file in --state-dir
+      --only-if-newer      skip reports collected before the last one sent
+                               for the same server; needs --state-dir
+      --dedupe-window=DURATION
+                           skip reports identical to the last one sent for the
+                               same server, if that was within DURATION, like
+                               "1m"; needs --state-dir
+      --force              send reports even if skipped by --dedupe-window
+      --only-if-primary    skip reports of servers that are in recovery, so
+                               that the same configuration can be used on
+                               the primary and its replicas
+      --only-if-replica    skip reports of servers that are not in recovery
+      --dry-run            for report commands, check the input but do not
+                               send it
+      --dump-on-error=FILE if the server rejects the report, write it to FILE
+                               as JSON (without the API key)
+      --dump-curl          print a curl command that makes the same request
+                               to stderr, with the body in a temporary file
+                               and without the API key or password
+      --unsafe-dump-curl   like --dump-curl, but keep the API key and password
+      --on-failure-url=URL POST details of the failure to URL if the command
+                               fails, see README.md
+      --lock-file=FILE     exit if another pgdash holds a lock on FILE
+      --summary-file=FILE  append a line of JSON to FILE for each report sent,
+                               and for each failure, see README.md
+      --after-success-command=COMMAND
+                           run COMMAND with the shell after each report is
+                               sent, with PGDASH_SERVER, PGDASH_BYTES,
+                               PGDASH_DURATION_MS etc. set, see README.md
+      --strict-hooks       fail if the --after-success-command fails, instead
+                               of only logging a warning
   -V, --version            output version information, then exit
       --debug              output debugging information
+      --trace              output time taken by DNS, connect, TLS etc. for each
+                               HTTP request
+      --dump-model-stats   log the size of each section of the report read
+                               from the input, largest first
+      --quiet              do not print a summary line on success
+      --output=FORMAT      print the summary line as "text" (default), or as a
+                               JSON object, which is also printed on failure
+                               with an error code, see README.md
   -h, --help[=options]     show this help, then exit
       --help=variables     list environment variables, then exit
 
 Commands:
-  report SERVERNAME        send report for PostgreSQL server SERVERNAME
+  report SERVERNAME...     send report for PostgreSQL server SERVERNAME
+  report --archive=FILE    send reports for each PostgreSQL server in FILE
+  report --multi-doc [SERVERNAME]
+                           send reports for each PostgreSQL server in input
   report-pgbouncer SERVERNAME PGBOUNCERNAME
                            send PgBouncer report for PgBouncer instance PGBOUNCERNAME
                                pooling connections for PostgreSQL server SERVERNAME
   report-pgpool PGPOOLNAME send report for Pgpool server PGPOOLNAME
+  diff OLDFILE NEWFILE     summarize differences between two pgmetrics JSON files
+  stats FILE               summarize the contents of a pgmetrics JSON file
+  list-sections            list the names of the sections of a report, for
+                               --include-sections and similar options
+  set-key ACCOUNT          store the API key given with -a (or read from stdin)
+                               in the system keyring under ACCOUNT
+  delete-key ACCOUNT       remove the API key for ACCOUNT from the system keyring
+
+Exit status:
+  0                        success
+  1                        error
+  2                        invalid command-line usage
+  3                        could not resolve the host in the base URL
+  4                        lock file is held by another pgdash process
+  5                        server rejected the request (HTTP 4xx), like for an
+                               invalid API key
+  6                        server is rate limiting requests (HTTP 429)
+  7                        server or gateway error (HTTP 5xx)
+  8                        could not connect to the server, or timed out
+  9                        input is not valid JSON, or does not have the
+                               types of the pgmetrics model
 
 For more information, visit <https://pgdash.io>.
 `
@@ -62,38 +326,237 @@ Usage:
   NAME=VALUE [NAME=VALUE] pgdash ...
 
   PDAPIKEY           API key for your pgdash account
+  PDHTTPPASSWORD     password for HTTP basic auth, if --http-password is not
+                     given
+  PDSIGNINGKEY       key to sign request bodies with, if --signing-key is not
+                     given
+  VAULT_ADDR         address of the Vault server, for --vault-path
+  VAULT_TOKEN        token to authenticate to Vault with, for --vault-path
+  VAULT_NAMESPACE    Vault namespace, for --vault-path (optional)
 `
 
+// exit codes, other than 0 (success), 1 (errors) and 2 (bad usage)
+const (
+	exitDNS       = 3 // could not resolve the host in the base URL
+	exitLocked    = 4 // lock file is held by another process
+	exitRejected  = 5 // server rejected the request (HTTP 4xx)
+	exitRateLimit = 6 // server rate limited the request (HTTP 429)
+	exitServer    = 7 // server or gateway error (HTTP 5xx)
+	exitNetwork   = 8 // could not connect to the server, or timed out
+	exitBadJSON   = 9 // input is not valid JSON, or of the wrong types
+)
+
+// errLocked is returned by lockFile if the lock is held by another process.
+var errLocked = errors.New("lock is held by another process")
+
+// rxHeader matches valid HTTP header names.
+var rxHeader = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
 var version string // set during build
 
 var client *api.RestV1Client
 
-const baseURL = "https://app.pgdash.io/api/v1"
+const (
+	baseURL    = "https://app.pgdash.io"
+	apiVersion = "v1"
+)
 
 type options struct {
 	// general
 	timeoutSec uint
+	reportTout uint
+	pgbTout    uint
+	pgpoolTout uint
 	retries    uint
+	backoffSd  int64
+	backoffSet bool
+	minBPS     uint
+	maxResp    uint
+	stream     bool
 	input      string
 	apiKey     string
+	keyring    string
 	version    bool
 	help       string
 	helpShort  bool
 	baseURL    string
+	apiVersion string
+	expandEnv  bool
 	debug      bool
+	trace      bool
+	quiet      bool
+	prefix     string
+	suffix     string
+	stripPgb   bool
+	strict     bool
+	multi      bool
+	sampleRate float64
+	failureURL string
+	lockFile   string
+	raw        bool
+	schema     bool
+	noUAAppend bool
+	archive    string
+	connOnly   bool
+	netWait    time.Duration
+	modelStats bool
+	watch      time.Duration
+	jitter     time.Duration
+	jitterEach bool
+	jitterSeed string
+	dumpOnErr  string
+	dumpCurl   bool
+	curlAll    bool
+	destList   []string
+	dests      []destination
+	expectSec  []string
+	zeroEmpty  bool
+	inclSec    []string
+	exclSec    []string
+	dryRun     bool
+	httpUser   string
+	httpPass   string
+	signKey    string
+	signHdr    string
+	contMD5    bool
+	noRedir    bool
+	noProxy    []string
+	failOnWarn bool
+	hostName   bool
+	shortHost  bool
+	srvTmpl    string
+	raMin      time.Duration
+	raMax      time.Duration
+	onlyNewer  bool
+	dedupe     time.Duration
+	force      bool
+	onlyPrim   bool
+	onlyRepl   bool
+	stateDir   string
+	stateGz    bool
+	output     string
+	noTimeChk  bool
+	clockOff   time.Duration
+	exec       string
+	execTout   time.Duration
+	transform  string
+	transTout  time.Duration
+	withPgb    string
+	retryTout  bool
+	summFile   string
+	afterCmd   string
+	strictHook bool
+	lowerName  bool
+	strictCase bool
+	multiDoc   bool
+	healthAddr string
+	selfEvery  time.Duration
+	cacheInput bool
+	vaultPath  string
+	truncQuery uint
+	normQuery  bool
+	dropEmpty  bool
+	prefer     string
+	strictVer  bool
 }
 
 func (o *options) defaults() {
 	// general
 	o.timeoutSec = 60
+	o.reportTout = 0
+	o.pgbTout = 0
+	o.pgpoolTout = 0
 	o.retries = 5
+	o.backoffSd = 0
+	o.backoffSet = false
+	o.minBPS = 0
+	o.maxResp = api.DefaultMaxResponseSize
+	o.stream = false
 	o.input = ""
 	o.apiKey = ""
+	o.keyring = ""
 	o.version = false
 	o.help = ""
 	o.helpShort = false
 	o.baseURL = baseURL
+	o.apiVersion = apiVersion
+	o.expandEnv = false
 	o.debug = false
+	o.trace = false
+	o.quiet = false
+	o.prefix = ""
+	o.suffix = ""
+	o.stripPgb = false
+	o.strict = false
+	o.multi = false
+	o.sampleRate = 1
+	o.failureURL = ""
+	o.lockFile = ""
+	o.raw = false
+	o.schema = false
+	o.noUAAppend = false
+	o.archive = ""
+	o.connOnly = false
+	o.netWait = 0
+	o.modelStats = false
+	o.watch = 0
+	o.jitter = 0
+	o.jitterEach = false
+	o.jitterSeed = ""
+	o.dumpOnErr = ""
+	o.dumpCurl = false
+	o.curlAll = false
+	o.destList = nil
+	o.dests = nil
+	o.expectSec = nil
+	o.zeroEmpty = false
+	o.inclSec = nil
+	o.exclSec = nil
+	o.dryRun = false
+	o.httpUser = ""
+	o.httpPass = ""
+	o.signKey = ""
+	o.signHdr = api.DefaultSigningHeader
+	o.contMD5 = false
+	o.noRedir = false
+	o.noProxy = nil
+	o.failOnWarn = false
+	o.hostName = false
+	o.shortHost = false
+	o.srvTmpl = ""
+	o.raMin = api.DefaultRetryAfterMin
+	o.raMax = api.DefaultRetryAfterMax
+	o.onlyNewer = false
+	o.dedupe = 0
+	o.force = false
+	o.onlyPrim = false
+	o.onlyRepl = false
+	o.stateDir = ""
+	o.stateGz = false
+	o.output = "text"
+	o.noTimeChk = false
+	o.clockOff = 0
+	o.exec = ""
+	o.execTout = 0
+	o.transform = ""
+	o.transTout = defaultTransformTimeout
+	o.withPgb = ""
+	o.retryTout = true
+	o.summFile = ""
+	o.afterCmd = ""
+	o.strictHook = false
+	o.lowerName = false
+	o.strictCase = false
+	o.multiDoc = false
+	o.healthAddr = ""
+	o.selfEvery = 0
+	o.cacheInput = false
+	o.vaultPath = ""
+	o.truncQuery = 0
+	o.normQuery = false
+	o.dropEmpty = false
+	o.prefer = ""
+	o.strictVer = false
 }
 
 func (o *options) usage(code int) {
@@ -109,37 +572,152 @@ func (o *options) usage(code int) {
 	os.Exit(code)
 }
 
+// float64Value is a getopt.Value for float64 options.
+type float64Value float64
+
+func (f *float64Value) Set(value string, opt getopt.Option) error {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return fmt.Errorf("invalid value for %s: %s", opt.Name(), value)
+	}
+	*f = float64Value(v)
+	return nil
+}
+
+func (f *float64Value) String() string {
+	return strconv.FormatFloat(float64(*f), 'g', -1, 64)
+}
+
 func printTry() {
 	fmt.Fprint(os.Stderr, "Try \"pgdash --help\" for more information.\n")
 }
 
-func (o *options) parse() (args []string) {
+// optionSet returns the getopt option set for the command-line options, which
+// are stored into o when parsed.
+func (o *options) optionSet() *getopt.Set {
 	// make getopt
 	s := getopt.New()
 	s.SetUsage(printTry)
 	s.SetProgram("pgdash")
 	// general
 	s.UintVarLong(&o.timeoutSec, "timeout", 0, "")
+	s.UintVarLong(&o.reportTout, "report-timeout", 0, "")
+	s.UintVarLong(&o.pgbTout, "report-pgbouncer-timeout", 0, "")
+	s.UintVarLong(&o.pgpoolTout, "report-pgpool-timeout", 0, "")
 	s.UintVarLong(&o.retries, "retries", 0, "")
+	s.Int64VarLong(&o.backoffSd, "backoff-seed", 0, "") // for testing, not documented
+	s.UintVarLong(&o.minBPS, "min-throughput", 0, "")
+	s.UintVarLong(&o.maxResp, "max-response-size", 0, "")
+	s.BoolVarLong(&o.stream, "stream", 0, "").SetFlag()
 	s.StringVarLong(&o.input, "input", 'i', "")
 	s.StringVarLong(&o.apiKey, "api-key", 'a', "")
-	help := s.StringVarLong(&o.help, "help", 'h', "").SetOptional()
+	s.StringVarLong(&o.keyring, "keyring", 0, "")
+	s.StringVarLong(&o.help, "help", 'h', "").SetOptional()
 	s.BoolVarLong(&o.version, "version", 'V', "").SetFlag()
 	s.StringVarLong(&o.baseURL, "base-url", 0, "")
+	s.StringVarLong(&o.apiVersion, "api-version", 0, "")
+	s.BoolVarLong(&o.expandEnv, "expand-env", 0, "").SetFlag()
 	s.BoolVarLong(&o.debug, "debug", 0, "").SetFlag()
+	s.BoolVarLong(&o.trace, "trace", 0, "").SetFlag()
+	s.BoolVarLong(&o.quiet, "quiet", 0, "").SetFlag()
+	s.StringVarLong(&o.prefix, "server-prefix", 0, "")
+	s.StringVarLong(&o.suffix, "server-suffix", 0, "")
+	s.BoolVarLong(&o.stripPgb, "strip-pgbouncer", 0, "").SetFlag()
+	s.BoolVarLong(&o.strict, "strict", 0, "").SetFlag()
+	s.BoolVarLong(&o.multi, "multi", 0, "").SetFlag()
+	s.VarLong((*float64Value)(&o.sampleRate), "sample-rate", 0, "")
+	s.StringVarLong(&o.failureURL, "on-failure-url", 0, "")
+	s.StringVarLong(&o.lockFile, "lock-file", 0, "")
+	s.BoolVarLong(&o.raw, "raw", 0, "").SetFlag()
+	s.BoolVarLong(&o.schema, "schema-validate", 0, "").SetFlag()
+	s.BoolVarLong(&o.noUAAppend, "no-user-agent-append", 0, "").SetFlag()
+	s.StringVarLong(&o.archive, "archive", 0, "")
+	s.BoolVarLong(&o.connOnly, "connect-only", 0, "").SetFlag()
+	s.DurationVarLong(&o.netWait, "wait-for-network", 0, "")
+	s.BoolVarLong(&o.modelStats, "dump-model-stats", 0, "").SetFlag()
+	s.DurationVarLong(&o.watch, "watch", 0, "")
+	s.DurationVarLong(&o.jitter, "jitter", 0, "")
+	s.BoolVarLong(&o.jitterEach, "jitter-each", 0, "").SetFlag()
+	s.StringVarLong(&o.jitterSeed, "jitter-seed", 0, "")
+	s.StringVarLong(&o.dumpOnErr, "dump-on-error", 0, "")
+	s.BoolVarLong(&o.dumpCurl, "dump-curl", 0, "").SetFlag()
+	s.BoolVarLong(&o.curlAll, "unsafe-dump-curl", 0, "").SetFlag()
+	s.ListVarLong(&o.destList, "destination", 0, "")
+	s.ListVarLong(&o.expectSec, "expect-section", 0, "")
+	s.BoolVarLong(&o.zeroEmpty, "exit-zero-on-empty", 0, "").SetFlag()
+	s.ListVarLong(&o.inclSec, "include-sections", 0, "")
+	s.ListVarLong(&o.exclSec, "exclude-sections", 0, "")
+	s.BoolVarLong(&o.dryRun, "dry-run", 0, "").SetFlag()
+	s.StringVarLong(&o.httpUser, "http-user", 0, "")
+	s.StringVarLong(&o.httpPass, "http-password", 0, "")
+	s.StringVarLong(&o.signKey, "signing-key", 0, "")
+	s.StringVarLong(&o.signHdr, "signing-header", 0, "")
+	s.BoolVarLong(&o.contMD5, "content-md5", 0, "").SetFlag()
+	s.BoolVarLong(&o.noRedir, "no-follow-redirects", 0, "").SetFlag()
+	s.ListVarLong(&o.noProxy, "no-proxy", 0, "")
+	s.BoolVarLong(&o.failOnWarn, "fail-on-warnings", 0, "").SetFlag()
+	s.BoolVarLong(&o.hostName, "server-name-from-hostname", 0, "").SetFlag()
+	s.BoolVarLong(&o.shortHost, "short-hostname", 0, "").SetFlag()
+	s.StringVarLong(&o.srvTmpl, "server-template", 0, "")
+	s.DurationVarLong(&o.raMin, "retry-after-min", 0, "")
+	s.DurationVarLong(&o.raMax, "retry-after-max", 0, "")
+	s.BoolVarLong(&o.onlyNewer, "only-if-newer", 0, "").SetFlag()
+	s.DurationVarLong(&o.dedupe, "dedupe-window", 0, "")
+	s.BoolVarLong(&o.force, "force", 0, "").SetFlag()
+	s.BoolVarLong(&o.onlyPrim, "only-if-primary", 0, "").SetFlag()
+	s.BoolVarLong(&o.onlyRepl, "only-if-replica", 0, "").SetFlag()
+	s.StringVarLong(&o.stateDir, "state-dir", 0, "")
+	s.BoolVarLong(&o.stateGz, "compress-state", 0, "").SetFlag()
+	s.StringVarLong(&o.output, "output", 0, "")
+	s.BoolVarLong(&o.noTimeChk, "no-time-check", 0, "").SetFlag()
+	s.DurationVarLong(&o.clockOff, "clock-offset", 0, "")
+	s.StringVarLong(&o.exec, "exec", 0, "")
+	s.DurationVarLong(&o.execTout, "exec-timeout", 0, "")
+	s.StringVarLong(&o.transform, "transform", 0, "")
+	s.DurationVarLong(&o.transTout, "transform-timeout", 0, "")
+	s.StringVarLong(&o.withPgb, "with-pgbouncer", 0, "")
+	s.BoolVarLong(&o.retryTout, "retry-on-timeout", 0, "")
+	s.StringVarLong(&o.summFile, "summary-file", 0, "")
+	s.StringVarLong(&o.afterCmd, "after-success-command", 0, "")
+	s.BoolVarLong(&o.strictHook, "strict-hooks", 0, "").SetFlag()
+	s.BoolVarLong(&o.lowerName, "lowercase-server", 0, "").SetFlag()
+	s.BoolVarLong(&o.strictCase, "strict-case", 0, "").SetFlag()
+	s.BoolVarLong(&o.multiDoc, "multi-doc", 0, "").SetFlag()
+	s.StringVarLong(&o.healthAddr, "health-endpoint", 0, "")
+	s.DurationVarLong(&o.selfEvery, "report-interval-metrics", 0, "")
+	s.BoolVarLong(&o.cacheInput, "cache-input", 0, "").SetFlag()
+	s.StringVarLong(&o.vaultPath, "vault-path", 0, "")
+	s.UintVarLong(&o.truncQuery, "truncate-query-length", 0, "")
+	s.BoolVarLong(&o.normQuery, "normalize-whitespace-queries", 0, "").SetFlag()
+	s.BoolVarLong(&o.dropEmpty, "drop-empty-databases", 0, "").SetFlag()
+	s.StringVarLong(&o.prefer, "prefer", 0, "")
+	s.BoolVarLong(&o.strictVer, "abort-on-schema-mismatch", 0, "").SetFlag()
+
+	return s
+}
+
+func (o *options) parse() (args []string) {
+	s := o.optionSet()
 
 	// parse
 	s.Parse(os.Args)
-	if help.Seen() && o.help == "" {
+	if s.Lookup("help").Seen() && o.help == "" {
 		o.help = "short"
 	}
+	o.backoffSet = s.Lookup("backoff-seed").Seen()
 
 	// check environment variables
-	if o.apiKey == "" {
+	if o.apiKey == "" && o.keyring == "" && o.vaultPath == "" {
 		if v := os.Getenv("PDAPIKEY"); v != "" {
 			o.apiKey = v
 		}
 	}
+	if o.httpPass == "" {
+		o.httpPass = os.Getenv("PDHTTPPASSWORD")
+	}
+	if o.signKey == "" {
+		o.signKey = os.Getenv("PDSIGNINGKEY")
+	}
 
 	// check values
 	if o.help != "" && o.help != "short" && o.help != "variables" {
@@ -156,6 +734,220 @@ func (o *options) parse() (args []string) {
 		printTry()
 		os.Exit(2)
 	}
+	if o.netWait < 0 {
+		fmt.Fprintln(os.Stderr, "wait-for-network must not be negative")
+		printTry()
+		os.Exit(2)
+	}
+	if o.raMin < 0 || o.raMax < o.raMin {
+		fmt.Fprintln(os.Stderr, "retry-after-min must not be negative or more than retry-after-max")
+		printTry()
+		os.Exit(2)
+	}
+	if o.sampleRate < 0 || o.sampleRate > 1 {
+		fmt.Fprintln(os.Stderr, "sample-rate must be between 0.0 and 1.0")
+		printTry()
+		os.Exit(2)
+	}
+	if o.prefer != "" && o.prefer != api.FamilyIPv4 && o.prefer != api.FamilyIPv6 {
+		fmt.Fprintln(os.Stderr, "prefer must be ipv4 or ipv6")
+		printTry()
+		os.Exit(2)
+	}
+	if o.output != "text" && o.output != "json" {
+		fmt.Fprintln(os.Stderr, "output must be text or json")
+		printTry()
+		os.Exit(2)
+	}
+	if o.maxResp == 0 {
+		fmt.Fprintln(os.Stderr, "max-response-size must be greater than 0")
+		printTry()
+		os.Exit(2)
+	}
+	if o.expandEnv {
+		for _, v := range []*string{&o.baseURL, &o.input, &o.lockFile, &o.archive, &o.dumpOnErr, &o.stateDir, &o.summFile} {
+			var err error
+			if *v, err = expandEnv(*v); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				printTry()
+				os.Exit(2)
+			}
+		}
+	}
+	if o.input == "-" {
+		o.input = "" // read from stdin
+	}
+	if u, err := checkBaseURL(o.baseURL, o.apiVersion); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		printTry()
+		os.Exit(2)
+	} else {
+		o.baseURL = u
+	}
+	for _, v := range o.destList {
+		d, err := parseDestination(*o, v)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			printTry()
+			os.Exit(2)
+		}
+		o.dests = append(o.dests, d)
+	}
+	for _, name := range append(append(o.expectSec, o.inclSec...), o.exclSec...) {
+		if api.ExpandSection(name) == nil {
+			fmt.Fprintf(os.Stderr, "unknown section '%s', must be one of: %s\n", name,
+				strings.Join(api.Sections(), ", "))
+			printTry()
+			os.Exit(2)
+		}
+	}
+	if len(o.inclSec) > 0 && len(o.exclSec) > 0 {
+		fmt.Fprintln(os.Stderr, "--include-sections cannot be used with --exclude-sections")
+		printTry()
+		os.Exit(2)
+	}
+	if len(o.keyring) > 0 && len(o.vaultPath) > 0 {
+		fmt.Fprintln(os.Stderr, "--keyring cannot be used with --vault-path")
+		printTry()
+		os.Exit(2)
+	}
+	if len(o.signKey) > 0 && o.stream {
+		fmt.Fprintln(os.Stderr, "--signing-key cannot be used with --stream")
+		printTry()
+		os.Exit(2)
+	}
+	if o.contMD5 && o.stream {
+		fmt.Fprintln(os.Stderr, "--content-md5 cannot be used with --stream")
+		printTry()
+		os.Exit(2)
+	}
+	if !rxHeader.MatchString(o.signHdr) {
+		fmt.Fprintln(os.Stderr, "signing-header must be a valid HTTP header name")
+		printTry()
+		os.Exit(2)
+	}
+	if len(o.httpPass) > 0 && len(o.httpUser) == 0 {
+		fmt.Fprintln(os.Stderr, "--http-password needs --http-user")
+		printTry()
+		os.Exit(2)
+	}
+	if o.transTout <= 0 {
+		fmt.Fprintln(os.Stderr, "transform-timeout must be positive")
+		printTry()
+		os.Exit(2)
+	}
+	if o.raw && (o.stripPgb || o.truncQuery > 0 || o.normQuery || o.dropEmpty || len(o.transform) > 0 || o.clockOff != 0) {
+		fmt.Fprintln(os.Stderr, "--raw cannot be used with --strip-pgbouncer, --truncate-query-length, --normalize-whitespace-queries, --drop-empty-databases, --transform or --clock-offset")
+		printTry()
+		os.Exit(2)
+	}
+	if len(o.srvTmpl) > 0 {
+		if _, err := template.New("server").Parse(o.srvTmpl); err != nil {
+			fmt.Fprintf(os.Stderr, "bad server template: %v\n", err)
+			printTry()
+			os.Exit(2)
+		}
+		if o.hostName || o.multi || o.multiDoc || len(o.archive) > 0 || len(o.withPgb) > 0 {
+			fmt.Fprintln(os.Stderr, "--server-template cannot be used with --server-name-from-hostname, --multi, --multi-doc, --archive or --with-pgbouncer")
+			printTry()
+			os.Exit(2)
+		}
+	}
+	if o.onlyPrim && o.onlyRepl {
+		fmt.Fprintln(os.Stderr, "--only-if-primary cannot be used with --only-if-replica")
+		printTry()
+		os.Exit(2)
+	}
+	if o.strictHook && len(o.afterCmd) == 0 {
+		fmt.Fprintln(os.Stderr, "--strict-hooks needs --after-success-command")
+		printTry()
+		os.Exit(2)
+	}
+	if o.lowerName && o.strictCase {
+		fmt.Fprintln(os.Stderr, "--lowercase-server cannot be used with --strict-case")
+		printTry()
+		os.Exit(2)
+	}
+	if len(o.withPgb) > 0 && (o.raw || o.stripPgb || o.multi || len(o.archive) > 0) {
+		fmt.Fprintln(os.Stderr, "--with-pgbouncer cannot be used with --raw, --strip-pgbouncer, --multi or --archive")
+		printTry()
+		os.Exit(2)
+	}
+	if len(o.withPgb) > 0 && !api.RxServer.MatchString(o.withPgb) {
+		fmt.Fprintln(os.Stderr, `bad PgBouncer name, must be 1-64 chars A-Z, a-z, 0-9, "-", "_", and ".".`)
+		printTry()
+		os.Exit(2)
+	}
+	if o.multiDoc && (o.multi || len(o.archive) > 0 || len(o.withPgb) > 0) {
+		fmt.Fprintln(os.Stderr, "--multi-doc cannot be used with --multi, --archive or --with-pgbouncer")
+		printTry()
+		os.Exit(2)
+	}
+	if len(o.archive) > 0 && (len(o.input) > 0 || o.multi) {
+		fmt.Fprintln(os.Stderr, "--archive cannot be used with --input or --multi")
+		printTry()
+		os.Exit(2)
+	}
+	if o.watch < 0 || (o.watch > 0 && o.watch < time.Second) {
+		fmt.Fprintln(os.Stderr, "watch interval must be at least 1s")
+		printTry()
+		os.Exit(2)
+	}
+	if o.jitter < 0 || (o.jitter > 0 && o.watch == 0) {
+		fmt.Fprintln(os.Stderr, "jitter must be positive, and can only be used with --watch")
+		printTry()
+		os.Exit(2)
+	}
+	if len(o.exec) > 0 && (len(o.input) > 0 || len(o.archive) > 0) {
+		fmt.Fprintln(os.Stderr, "--exec cannot be used with --input or --archive")
+		printTry()
+		os.Exit(2)
+	}
+	if o.execTout < 0 || (o.execTout > 0 && len(o.exec) == 0) {
+		fmt.Fprintln(os.Stderr, "exec-timeout must be positive, and can only be used with --exec")
+		printTry()
+		os.Exit(2)
+	}
+	if o.cacheInput && (o.watch == 0 || len(o.input) == 0 || o.multiDoc) {
+		fmt.Fprintln(os.Stderr, "--cache-input needs --watch and --input, and cannot be used with --multi-doc")
+		printTry()
+		os.Exit(2)
+	}
+	if len(o.healthAddr) > 0 && o.watch == 0 {
+		fmt.Fprintln(os.Stderr, "--health-endpoint can only be used with --watch")
+		printTry()
+		os.Exit(2)
+	}
+	if o.selfEvery < 0 || (o.selfEvery > 0 && o.watch == 0) {
+		fmt.Fprintln(os.Stderr, "report-interval-metrics must not be negative, and needs --watch")
+		printTry()
+		os.Exit(2)
+	}
+	if o.watch > 0 && len(o.input) == 0 && len(o.archive) == 0 && len(o.exec) == 0 {
+		fmt.Fprintln(os.Stderr, "--watch needs --input, --archive or --exec, as stdin can be read only once")
+		printTry()
+		os.Exit(2)
+	}
+	if o.onlyNewer && len(o.stateDir) == 0 {
+		fmt.Fprintln(os.Stderr, "--only-if-newer needs --state-dir")
+		printTry()
+		os.Exit(2)
+	}
+	if o.dedupe > 0 && len(o.stateDir) == 0 {
+		fmt.Fprintln(os.Stderr, "--dedupe-window needs --state-dir")
+		printTry()
+		os.Exit(2)
+	}
+	if len(o.prefix) > 0 && !api.RxServer.MatchString(o.prefix) {
+		fmt.Fprintln(os.Stderr, `bad server prefix, must be chars A-Z, a-z, 0-9, "-", "_", and ".".`)
+		printTry()
+		os.Exit(2)
+	}
+	if s := serverSuffix(*o); len(s) > 0 && !api.RxServer.MatchString(s) {
+		fmt.Fprintln(os.Stderr, `bad server suffix, must be chars A-Z, a-z, 0-9, "-", "_", and ".", and {year}, {month}, {date} or {hour}.`)
+		printTry()
+		os.Exit(2)
+	}
 
 	// help action
 	if o.helpShort || o.help == "short" || o.help == "variables" {
@@ -173,61 +965,469 @@ func (o *options) parse() (args []string) {
 
 	// check the command
 	args = s.Args()
+	if o.connOnly {
+		if len(args) != 0 || o.watch > 0 {
+			fmt.Fprintln(os.Stderr, "a command cannot be specified with --connect-only")
+			printTry()
+			os.Exit(2)
+		}
+		return args
+	}
 	if len(args) == 0 {
 		fmt.Fprintln(os.Stderr, "a command must be specified")
 		printTry()
 		os.Exit(2)
 	}
-	command := args[0]
-	if command != "report" && command != "report-pgbouncer" && command != "report-pgpool" {
+	switch command := args[0]; command {
+	case "report", "report-pgbouncer", "report-pgpool", "diff", "stats",
+		"set-key", "delete-key", "describe", "bench", "echo-server", "list-sections":
+	default:
 		fmt.Fprintf(os.Stderr, "unknown command '%s'\n", command)
 		printTry()
 		os.Exit(2)
 	}
+	// use the command-specific timeout, if given
+	var tout uint
+	switch args[0] {
+	case "report":
+		tout = o.reportTout
+	case "report-pgbouncer":
+		tout = o.pgbTout
+	case "report-pgpool":
+		tout = o.pgpoolTout
+	}
+	if tout > 0 {
+		o.timeoutSec = tout
+	}
+	if o.watch > 0 && !strings.HasPrefix(args[0], "report") {
+		fmt.Fprintf(os.Stderr, "--watch cannot be used with %s\n", args[0])
+		printTry()
+		os.Exit(2)
+	}
 
 	return args
 }
 
-const sixMonths = time.Duration(180 * 24 * time.Hour)
+// checkBaseURL checks if s is a valid base URL, and returns the base URL for
+// the given API version.
+func checkBaseURL(s, version string) (string, error) {
+	u, err := url.Parse(s)
+	if err == nil && u.Scheme == "unix" {
+		if fi, err := os.Stat(u.Path); err != nil {
+			return "", fmt.Errorf("invalid base URL '%s': %v", s, err)
+		} else if fi.Mode()&os.ModeSocket == 0 {
+			return "", fmt.Errorf("invalid base URL '%s': %s is not a socket", s, u.Path)
+		}
+		return api.VersionedBaseURL(s, version)
+	}
+	if err != nil || (u.Scheme != "file" && len(u.Host) == 0) ||
+		(u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "file") {
+		return "", fmt.Errorf("invalid base URL '%s'", s)
+	}
+	return api.VersionedBaseURL(s, version)
+}
+
+// expandEnv replaces $VAR and ${VAR} in s with the values of the environment
+// variables. Unlike os.ExpandEnv, it is an error for a variable to be unset or
+// empty.
+func expandEnv(s string) (string, error) {
+	var missing []string
+	s = os.Expand(s, func(name string) string {
+		v := os.Getenv(name)
+		if len(v) == 0 {
+			missing = append(missing, name)
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variable(s) not set: %s", strings.Join(missing, ", "))
+	}
+	return s, nil
+}
+
+// readAll reads everything from f. If f is a regular file (like when stdin is
+// redirected from a file), the buffer is sized up front, which avoids repeated
+// reallocation and copying while reading large inputs.
+func readAll(f *os.File) ([]byte, error) {
+	var buf bytes.Buffer
+	if fi, err := f.Stat(); err == nil && fi.Mode().IsRegular() {
+		buf.Grow(int(fi.Size()) + bytes.MinRead)
+	}
+	_, err := buf.ReadFrom(f)
+	return buf.Bytes(), err
+}
+
+// readFile reads the named file. Unlike os.ReadFile, it does not rely on the
+// size of non-regular files like FIFOs and devices, and just reads them until
+// EOF.
+func readFile(name string) ([]byte, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readAll(f)
+}
 
-func getReport(o options) *pgmetrics.Model {
-	// read input file
+func readInput(o options) []byte {
 	var data []byte
 	var err error
-	if len(o.input) > 0 {
-		data, err = os.ReadFile(o.input)
+	if len(o.exec) > 0 {
+		data = execInput(o)
+	} else if len(o.input) > 0 {
+		data, err = readFile(o.input)
 	} else {
-		data, err = io.ReadAll(os.Stdin)
+		data, err = readAll(os.Stdin)
 	}
 	if err != nil {
-		log.Fatalf("failed to read input: %v", err)
+		fatalCode(errCodeInvalidInput, "failed to read input: %v", err)
 	}
 	if o.debug {
 		log.Printf("read input: %d bytes", len(data))
 	}
+	return data
+}
+
+// checkValid exits with a suitable message if err, returned from validating
+// the model, is not nil.
+func checkValid(err error) {
+	if err == api.ErrHasPgBouncer {
+		fatalCode(errCodeInvalidInput, "use report-pgbouncer to send PgBouncer information")
+	} else if err == api.ErrNoPgBouncer || err == api.ErrNoPgpool {
+		fatalCode(errCodeInvalidInput, "%v", err)
+	} else if err != nil {
+		fatalCode(errCodeInvalidInput, "invalid input: %v", err)
+	}
+}
+
+// maxSchemaErrors is the maximum number of schema violations that are listed.
+const maxSchemaErrors = 20
+
+// checkSchema exits if --schema-validate was given and the JSON-encoded model
+// does not match the structure of the pgmetrics model.
+func checkSchema(o options, data []byte) {
+	if !o.schema {
+		return
+	}
+	errs := api.ValidateSchema(data)
+	for i, e := range errs {
+		if i == maxSchemaErrors {
+			log.Printf("schema: ...and %d more", len(errs)-i)
+			break
+		}
+		log.Printf("schema: %v", e)
+	}
+	if len(errs) > 0 {
+		fatalCode(errCodeInvalidInput, "invalid input: does not match the pgmetrics schema (%d problems)", len(errs))
+	}
+	if o.debug {
+		log.Print("input matches the pgmetrics schema")
+	}
+}
+
+// skipIfEmpty exits with status 0 if --exit-zero-on-empty was given and the
+// input has nothing to report. With --watch, only the current run ends.
+func skipIfEmpty(o options, data []byte) {
+	if !o.zeroEmpty || !api.IsEmptyModel(data) {
+		return
+	}
+	log.Print("input is empty, nothing to report")
+	if watching {
+		panic(watchAbort{code: 0})
+	}
+	os.Exit(0)
+}
+
+// checkSections exits if any of the sections given with --expect-section are
+// missing or empty in the JSON-encoded model.
+func checkSections(o options, data []byte) {
+	if len(o.expectSec) == 0 {
+		return
+	}
+	if err := api.CheckSections(data, o.expectSec); err != nil {
+		fatalCode(errCodeInvalidInput, "invalid input: %v", err)
+	}
+}
+
+// filterSections returns the JSON-encoded model with only the sections
+// selected by --include-sections or --exclude-sections, if given.
+func filterSections(o options, data []byte) []byte {
+	if len(o.inclSec) == 0 && len(o.exclSec) == 0 {
+		return data
+	}
+	out, err := api.FilterSections(data, o.inclSec, o.exclSec)
+	if err != nil {
+		fatalCode(errCodeInvalidInput, "invalid input: %v", err)
+	}
+	if o.debug {
+		log.Printf("selected sections of input, %d bytes to %d", len(data), len(out))
+	}
+	return out
+}
+
+// snippetLen is the number of bytes of input shown on either side of the
+// location of a JSON error.
+const snippetLen = 30
+
+// checkJSON exits if the input is not valid JSON, saying where the problem is.
+func checkJSON(data []byte) {
+	if !json.Valid(data) {
+		var v json.RawMessage
+		badJSON(data, json.Unmarshal(data, &v))
+	}
+}
+
+// badJSON exits with a message for err, returned from decoding the input
+// data. The location of JSON syntax and type errors is included, along with
+// the input around it, and the exit status is then exitBadJSON.
+func badJSON(data []byte, err error) {
+	var serr *json.SyntaxError
+	var terr *json.UnmarshalTypeError
+	var off int64
+	if errors.As(err, &serr) {
+		off = serr.Offset
+	} else if errors.As(err, &terr) {
+		off = terr.Offset
+	} else {
+		fatalCode(errCodeInvalidInput, "invalid input: %v", err)
+	}
+	if off > int64(len(data)) {
+		off = int64(len(data))
+	}
+	line, col := 1, 1
+	for i := int64(0); i < off-1; i++ { // the error is at the byte before off
+		b := data[i]
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	from, to := off-snippetLen, off+snippetLen
+	if from < 0 {
+		from = 0
+	}
+	if to > int64(len(data)) {
+		to = int64(len(data))
+	}
+	failure.code = errCodeInvalidInput
+	die(exitBadJSON, fmt.Sprintf("invalid input: %v, at line %d column %d (byte offset %d), near %q",
+		err, line, col, off, data[from:to]))
+}
 
-	// unmarshal json
+// decodeModel decodes the JSON-encoded pgmetrics model.
+func decodeModel(o options, data []byte) *pgmetrics.Model {
 	var model pgmetrics.Model
 	if err := json.Unmarshal(data, &model); err != nil {
-		log.Fatalf("invalid input: %v", err)
+		badJSON(data, err)
 	}
 	if o.debug {
 		log.Print("decoded input JSON successfully")
 	}
+	return &model
+}
 
-	// validate the data a bit
-	ver := model.Metadata.Version
-	if !strings.HasPrefix(ver, "1.") { // we currently know only about major version 1
-		log.Fatalf("invalid input: bad schema version '%s' in pgmetrics json",
-			ver)
+// validateOptions returns the options for validating a model carrying the
+// given payload. An unexpected schema version is only warned about, unless
+// --abort-on-schema-mismatch was given.
+func validateOptions(o options, payload api.Payload) api.ValidateOptions {
+	vo := api.DefaultValidateOptions()
+	vo.Payload = payload
+	vo.NoTimeCheck = o.noTimeChk
+	if !o.strictVer {
+		vo.OnVersionMismatch = func(err error) {
+			warnf("%v, continuing anyway", err)
+		}
+	}
+	return vo
+}
+
+// validateModel checks if the model is acceptable, and exits if not.
+func validateModel(o options, model *pgmetrics.Model, payload api.Payload) {
+	checkValid(api.ValidateModel(model, validateOptions(o, payload)))
+}
+
+// stripPgBouncer drops the PgBouncer information from the model if
+// --strip-pgbouncer was given and a PostgreSQL report is being sent.
+func stripPgBouncer(o options, model *pgmetrics.Model, payload api.Payload) {
+	if payload == api.PayloadPostgres && o.stripPgb && model.PgBouncer != nil {
+		model.PgBouncer = nil
+		if o.debug {
+			log.Print("removed PgBouncer information from input")
+		}
 	}
-	at := time.Unix(model.Metadata.At, 0)
-	now := time.Now()
-	if at.Before(now.Add(-sixMonths)) || at.After(now.Add(sixMonths)) {
-		log.Fatalf("invalid input: bad collection timestamp in pgmetrics json: %v", at)
+}
+
+// isEmptyDatabase returns true if all the activity counters of the database,
+// that is everything but its OID, name, size and stats reset time, are zero.
+func isEmptyDatabase(d *pgmetrics.Database) bool {
+	return d.NumBackends == 0 && d.XactCommit == 0 && d.XactRollback == 0 &&
+		d.BlksRead == 0 && d.BlksHit == 0 && d.TupReturned == 0 &&
+		d.TupFetched == 0 && d.TupInserted == 0 && d.TupUpdated == 0 &&
+		d.TupDeleted == 0 && d.Conflicts == 0 && d.TempFiles == 0 &&
+		d.TempBytes == 0 && d.Deadlocks == 0 && d.BlkReadTime == 0 &&
+		d.BlkWriteTime == 0
+}
+
+// dropEmptyDatabases removes the empty databases from the model, if
+// --drop-empty-databases was given, along with the rows of other sections
+// that belong to them.
+func dropEmptyDatabases(o options, model *pgmetrics.Model) {
+	if !o.dropEmpty {
+		return
+	}
+	empty := make(map[string]bool)
+	dbs := model.Databases[:0]
+	for i := range model.Databases {
+		if d := &model.Databases[i]; isEmptyDatabase(d) {
+			empty[d.Name] = true
+		} else {
+			dbs = append(dbs, *d)
+		}
+	}
+	if len(empty) == 0 {
+		return
 	}
+	model.Databases = dbs
 
-	// append our user agent info into the model
+	collected := model.Metadata.CollectedDBs[:0]
+	for _, name := range model.Metadata.CollectedDBs {
+		if !empty[name] {
+			collected = append(collected, name)
+		}
+	}
+	model.Metadata.CollectedDBs = collected
+	tables := model.Tables[:0]
+	for _, t := range model.Tables {
+		if !empty[t.DBName] {
+			tables = append(tables, t)
+		}
+	}
+	model.Tables = tables
+	indexes := model.Indexes[:0]
+	for _, x := range model.Indexes {
+		if !empty[x.DBName] {
+			indexes = append(indexes, x)
+		}
+	}
+	model.Indexes = indexes
+	seqs := model.Sequences[:0]
+	for _, s := range model.Sequences {
+		if !empty[s.DBName] {
+			seqs = append(seqs, s)
+		}
+	}
+	model.Sequences = seqs
+	funcs := model.UserFunctions[:0]
+	for _, f := range model.UserFunctions {
+		if !empty[f.DBName] {
+			funcs = append(funcs, f)
+		}
+	}
+	model.UserFunctions = funcs
+	exts := model.Extensions[:0]
+	for _, e := range model.Extensions {
+		if !empty[e.DBName] {
+			exts = append(exts, e)
+		}
+	}
+	model.Extensions = exts
+	trigs := model.DisabledTriggers[:0]
+	for _, t := range model.DisabledTriggers {
+		if !empty[t.DBName] {
+			trigs = append(trigs, t)
+		}
+	}
+	model.DisabledTriggers = trigs
+	stmts := model.Statements[:0]
+	for _, s := range model.Statements {
+		if !empty[s.DBName] {
+			stmts = append(stmts, s)
+		}
+	}
+	model.Statements = stmts
+	plans := model.Plans[:0]
+	for _, p := range model.Plans {
+		if !empty[p.Database] {
+			plans = append(plans, p)
+		}
+	}
+	model.Plans = plans
+
+	if o.debug {
+		names := make([]string, 0, len(empty))
+		for name := range empty {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		log.Printf("dropped empty databases: %s", strings.Join(names, ", "))
+	}
+}
+
+// adjustClock adds --clock-offset, if given, to the collection time of the
+// model, to make up for a clock that is off on the host it is from.
+func adjustClock(o options, model *pgmetrics.Model) {
+	if o.clockOff == 0 {
+		return
+	}
+	at := model.Metadata.At
+	model.Metadata.At += int64(o.clockOff.Round(time.Second) / time.Second)
+	if o.debug {
+		log.Printf("adjusted collection time by %v, from %s to %s", o.clockOff,
+			time.Unix(at, 0).UTC().Format(time.RFC3339), time.Unix(model.Metadata.At, 0).UTC().Format(time.RFC3339))
+	}
+}
+
+// truncateQueries truncates the text of the queries in the model to
+// --truncate-query-length characters, if given, marking truncated ones with a
+// trailing "...".
+func truncateQueries(o options, model *pgmetrics.Model) {
+	if o.truncQuery == 0 {
+		return
+	}
+	var n int
+	trunc := func(q *string) {
+		if t, ok := truncateText(*q, int(o.truncQuery)); ok {
+			*q = t
+			n++
+		}
+	}
+	for i := range model.Backends {
+		trunc(&model.Backends[i].Query)
+	}
+	for i := range model.Statements {
+		trunc(&model.Statements[i].Query)
+	}
+	for i := range model.Plans {
+		trunc(&model.Plans[i].Query)
+	}
+	if o.debug && n > 0 {
+		log.Printf("truncated %d queries to %d characters", n, o.truncQuery)
+	}
+}
+
+// truncateText returns the first max characters (not bytes) of s followed by
+// "...", and true, if s is longer than that.
+func truncateText(s string, max int) (string, bool) {
+	if len(s) <= max { // fewer bytes, so fewer characters
+		return s, false
+	}
+	for i := range s {
+		if max == 0 {
+			return s[:i] + "...", true
+		}
+		max--
+	}
+	return s, false
+}
+
+// appendUserAgent adds pgdash/VERSION to the user agent in the model's
+// metadata, unless --no-user-agent-append was given.
+func appendUserAgent(o options, model *pgmetrics.Model) {
+	if o.noUAAppend {
+		return
+	}
 	if len(model.Metadata.UserAgent) > 0 {
 		model.Metadata.UserAgent += " "
 	}
@@ -237,145 +1437,672 @@ func getReport(o options) *pgmetrics.Model {
 	} else {
 		model.Metadata.UserAgent += "devel"
 	}
+}
 
-	return &model
+// dumpModelStats logs the JSON-encoded size of each top-level section of the
+// model, or of the raw input in --raw mode, largest first, if
+// --dump-model-stats was given.
+func dumpModelStats(o options, model *pgmetrics.Model, raw json.RawMessage) {
+	if !o.modelStats {
+		return
+	}
+	if model != nil {
+		var err error
+		if raw, err = json.Marshal(model); err != nil {
+			warnf("failed to encode model: %v", err)
+			return
+		}
+	}
+	var sections map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &sections); err != nil {
+		warnf("failed to decode model: %v", err)
+		return
+	}
+	names := make([]string, 0, len(sections))
+	for name := range sections {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if a, b := len(sections[names[i]]), len(sections[names[j]]); a != b {
+			return a > b
+		}
+		return names[i] < names[j]
+	})
+	log.Printf("model size: %s in %d sections", fmtBytes(int64(len(raw))), len(names))
+	for _, name := range names {
+		n := len(sections[name])
+		log.Printf("  %-28s %10s %5.1f%%", name+":", fmtBytes(int64(n)), 100*float64(n)/float64(len(raw)))
+	}
+}
+
+func getReport(o options, payload api.Payload) *pgmetrics.Model {
+	// use the report from the last run, if the input has not changed
+	fi := statInput(o)
+	if model, _, ok := cachedReport(o, fi, payload); ok {
+		return model
+	}
+
+	// read and decode input
+	data := readInput(o)
+	skipIfEmpty(o, data)
+	checkJSON(data)
+	checkSchema(o, data)
+	checkSections(o, data)
+	data = filterSections(o, data)
+	model := decodeModel(o, data)
+
+	// drop pgbouncer info and shorten queries if asked to
+	stripPgBouncer(o, model, payload)
+	dropEmptyDatabases(o, model)
+	normalizeQueries(o, model)
+	truncateQueries(o, model)
+	model = transformModel(o, model)
+	adjustClock(o, model)
+
+	// validate the data a bit
+	validateModel(o, model, payload)
+
+	// append our user agent info into the model, unless asked not to
+	appendUserAgent(o, model)
+	dumpModelStats(o, model, nil)
+
+	cacheReport(fi, payload, model, nil)
+	return model
 }
 
-func checkAPIKey(o options) {
+// getRawReport is like getReport, but for --raw mode. It checks only the
+// metadata of the input, and returns it unchanged.
+func getRawReport(o options, payload api.Payload) json.RawMessage {
+	fi := statInput(o)
+	if _, raw, ok := cachedReport(o, fi, payload); ok {
+		return raw
+	}
+	data := readInput(o)
+	skipIfEmpty(o, data)
+	checkJSON(data)
+	checkSchema(o, data)
+	checkSections(o, data)
+	data = filterSections(o, data)
+	checkValid(api.ValidateRaw(data, validateOptions(o, payload)))
+	if o.debug {
+		log.Print("validated raw input successfully")
+	}
+	dumpModelStats(o, nil, data)
+	cacheReport(fi, payload, nil, data)
+	return data
+}
+
+func checkAPIKey(o *options) {
+	if o.dryRun && len(o.apiKey) == 0 && len(o.keyring) == 0 && len(o.vaultPath) == 0 {
+		return // not needed
+	}
+	if len(o.apiKey) == 0 && len(o.keyring) > 0 {
+		key, err := keyringGet(o.keyring)
+		if err != nil {
+			fatalCode(errCodeAuth, "failed to get API key for %q from keyring: %v", o.keyring, err)
+		}
+		o.apiKey = key
+	}
+	if len(o.apiKey) == 0 && len(o.vaultPath) > 0 {
+		key, err := vaultGet(o.vaultPath)
+		if err != nil {
+			fatalCode(errCodeAuth, "failed to get API key from Vault: %v", err)
+		}
+		o.apiKey = key
+	}
 	if len(o.apiKey) == 0 {
-		log.Fatal("API key must be specified using the '-a' option for reporting.")
+		fatalCode(errCodeAuth, "API key must be specified using the '-a' option for reporting.")
 	}
 	if !api.RxAPIKey.MatchString(o.apiKey) {
-		log.Fatalf("invalid API key format '%s'", o.apiKey)
+		fatalCode(errCodeAuth, "invalid API key format '%s'", o.apiKey)
+	}
+}
+
+// netWaitInterval is how often waitForNetwork tries to connect.
+const netWaitInterval = time.Second
+
+// waitForNetwork waits up to --wait-for-network for a connection to the base
+// URL host to succeed, so that reports sent early during boot do not fail just
+// because the network is not up yet. It only warns if the wait times out, and
+// leaves it to the report to fail.
+func waitForNetwork(o options) {
+	if o.netWait == 0 || strings.HasPrefix(o.baseURL, "file:") {
+		return
+	}
+	deadline := time.Now().Add(o.netWait)
+	for {
+		s, err := client.Probe()
+		// a TLS failure is for the report to complain about
+		if err == nil || s.Connect > 0 {
+			if o.debug {
+				log.Printf("network is up, connected to %s", s.Addr)
+			}
+			return
+		}
+		if !time.Now().Add(netWaitInterval).Before(deadline) {
+			warnf("network not up after %v, trying anyway: %v", o.netWait, err)
+			return
+		}
+		if o.debug {
+			log.Printf("waiting for network: %v", err)
+		}
+		time.Sleep(netWaitInterval)
+	}
+}
+
+// cmdListSections prints the names of the top-level sections of the
+// pgmetrics model, one per line.
+func cmdListSections(args []string) {
+	if len(args) != 0 {
+		fatal("invalid syntax for list-sections command, try --help for help.")
+	}
+	for _, name := range api.Sections() {
+		fmt.Println(name)
+	}
+}
+
+// cmdConnect checks if a connection can be made to the pgDash server, without
+// making any API requests.
+func cmdConnect(o options) {
+	s, err := client.Probe()
+	if err != nil {
+		var errd *net.DNSError
+		if errors.As(err, &errd) {
+			failure.code = errCodeDNS
+			die(exitDNS, fmt.Sprintf("could not resolve host %s; check --base-url and DNS", errd.Name))
+		}
+		fatalf("connect to %s failed: %v", s.Addr, err)
+	}
+	if o.quiet {
+		return
 	}
+	via := ""
+	if len(s.Proxy) > 0 {
+		via = " proxy=" + s.Proxy
+	}
+	fmt.Printf("ok connect %s%s dns=%dms connect=%dms tls=%dms total=%dms\n",
+		s.Addr, via, s.DNS.Milliseconds(), s.Connect.Milliseconds(),
+		s.TLS.Milliseconds(), s.Total.Milliseconds())
+}
+
+// printSummary prints a single line to stdout describing a successful API
+// call. The format of this line is meant to be stable across versions, so that
+// it can be grepped for or parsed by scripts. It is also appended to the
+// --summary-file, if given.
+func printSummary(o options, s api.CallStats, names ...string) {
+	r := jsonResult{OK: true, Command: failure.Command, Bytes: s.Bytes,
+		Attempts: s.Attempts, DurationMS: s.Duration.Milliseconds()}
+	r.setNames(names)
+	appendSummary(r)
+	if o.quiet {
+		return
+	}
+	if outputJSON {
+		printJSON(r)
+		return
+	}
+	fmt.Printf("ok %s bytes=%d attempts=%d duration=%dms\n",
+		strings.Join(names, " "), s.Bytes, s.Attempts, s.Duration.Milliseconds())
+}
+
+// hostServerName returns the hostname of this machine, with characters not
+// allowed in server names replaced by "-", for use as the server name.
+func hostServerName(o options) string {
+	h, err := os.Hostname()
+	if err != nil {
+		fatalf("failed to get hostname: %v", err)
+	}
+	if o.shortHost {
+		h, _, _ = strings.Cut(h, ".")
+	}
+	h = strings.Map(func(r rune) rune {
+		if r < 128 && api.RxServer.MatchString(string(r)) {
+			return r
+		}
+		return '-'
+	}, h)
+	if o.debug {
+		log.Printf("using server name %q from hostname", h)
+	}
+	return h
+}
+
+// serverSuffix returns the --server-suffix, with the time tokens in it
+// replaced by the current time.
+func serverSuffix(o options) string {
+	if len(o.suffix) == 0 {
+		return ""
+	}
+	now := time.Now().UTC()
+	return strings.NewReplacer(
+		"{year}", now.Format("2006"),
+		"{month}", now.Format("200601"),
+		"{date}", now.Format("20060102"),
+		"{hour}", now.Format("2006010215"),
+	).Replace(o.suffix)
+}
+
+// fullServerName returns name with the --server-prefix and --server-suffix.
+func fullServerName(o options, name string) string {
+	return o.prefix + name + serverSuffix(o)
+}
+
+// checkServer returns the server name to report under, which is the name given
+// on the command-line with the server prefix and suffix, if any, added (see
+// fullServerName), and lowercased if --lowercase-server is set. It exits if the
+// resulting name is not valid.
+func checkServer(o options, name string) string {
+	server := fullServerName(o, name)
+	failure.Server = server
+	if !api.RxServer.MatchString(server) {
+		if len(o.prefix) > 0 || len(o.suffix) > 0 {
+			fatalf(`bad server name %q (with prefix or suffix), must be 1-64 chars A-Z, a-z, 0-9, "-", "_", and ".".`, server)
+		}
+		fatal(`bad server name, must be 1-64 chars A-Z, a-z, 0-9, "-", "_", and ".".`)
+	}
+	server = checkCase(o, "server", server)
+	failure.Server = server
+	return server
+}
+
+// checkCase returns the server, PgBouncer or Pgpool name in lowercase with
+// --lowercase-server, and exits if it is not lowercase with --strict-case.
+// Otherwise, it is returned as-is.
+func checkCase(o options, kind, name string) string {
+	lower := strings.ToLower(name)
+	if o.strictCase && name != lower {
+		fatalf("%s name %q is not in lowercase, and --strict-case was given", kind, name)
+	}
+	if o.lowerName && name != lower {
+		if o.debug {
+			log.Printf("using %s name %q instead of %q", kind, lower, name)
+		}
+		return lower
+	}
+	return name
+}
+
+// checkAPIError exits with a suitable message and exit code if err, returned
+// from an API call, is not nil. msg400 is the message for HTTP status 400.
+func checkAPIError(err error, msg400 string) {
+	if err != nil {
+		failure.code, failure.status = apiErrorCode(err)
+		die(exitCodeForError(err), apiErrorMessage(err, msg400))
+	}
+}
+
+// exitCodeForError returns the exit code for err, returned from an API call.
+// These are listed in the usage.
+func exitCodeForError(err error) int {
+	if errh, ok := err.(*api.RestV1ClientError); ok {
+		switch {
+		case errh.Code() == 429:
+			return exitRateLimit
+		case errh.Code() >= 400 && errh.Code() < 500:
+			return exitRejected
+		case errh.Code() >= 500:
+			return exitServer
+		}
+		return 1
+	}
+	var errd *net.DNSError
+	if errors.As(err, &errd) {
+		return exitDNS
+	}
+	var errn net.Error
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.As(err, &errn) {
+		return exitNetwork
+	}
+	return 1
+}
+
+// apiErrorMessage returns the message for err, returned from an API call.
+func apiErrorMessage(err error, msg400 string) string {
+	if errh, ok := err.(*api.RestV1ClientError); ok {
+		switch {
+		case errh.Code() == 400:
+			return msg400
+		case errh.Code() == 401 || errh.Code() == 403:
+			return fmt.Sprintf("request rejected by the server (HTTP %d), check the API key and --http-user", errh.Code())
+		case errh.Code() == 500:
+			return "internal server error"
+		case errh.Code() == 429:
+			return "rate limited by the server, try again later"
+		case errh.IsGatewayError():
+			return fmt.Sprintf("server unavailable (HTTP %d from gateway), it may be restarting, try again later", errh.Code())
+		}
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Sprintf("connection refused: %v; check that the server is running", err)
+	}
+	var errd *net.DNSError
+	if errors.As(err, &errd) {
+		return fmt.Sprintf("could not resolve host %s; check --base-url and DNS", errd.Name)
+	}
+	return fmt.Sprintf("API request failed: %v", err)
 }
 
 func cmdReport(o options, args []string) {
 	// check API key
-	checkAPIKey(o)
+	checkAPIKey(&o)
+
+	// use the hostname as the server name, if asked to
+	if o.hostName {
+		if len(args) != 0 || len(o.archive) > 0 {
+			fatal("server names cannot be specified with --server-name-from-hostname")
+		}
+		args = []string{hostServerName(o)}
+	}
+
+	// the server name comes from the input, if asked to
+	if len(o.srvTmpl) > 0 {
+		if len(args) != 0 {
+			fatal("server names cannot be specified with --server-template")
+		}
+		reportTemplated(o)
+		return
+	}
+
+	// reports from an archive are named after the files within
+	if len(o.archive) > 0 {
+		if len(args) != 0 {
+			fatal("server names cannot be specified with --archive")
+		}
+		reportArchive(o)
+		return
+	}
+
+	// the input has many reports, named after the hosts they are from
+	if o.multiDoc {
+		reportDocs(o, args)
+		return
+	}
 
-	// check server
+	// check server(s)
 	if len(args) == 0 {
-		log.Fatal("Server name needs to be specified, try --help for help.")
+		fatal("Server name needs to be specified, try --help for help.")
 	}
-	if len(args) != 1 {
-		log.Fatal("invalid syntax for report command, try --help for help.")
+	if len(args) != 1 && !o.multi {
+		fatal("invalid syntax for report command, use --multi to report under multiple server names.")
 	}
-	if !api.RxServer.MatchString(args[0]) {
-		log.Fatal(`bad server name, must be 1-64 chars A-Z, a-z, 0-9, "-", "_", and ".".`)
+	servers := make([]string, len(args))
+	for i, name := range args {
+		servers[i] = checkServer(o, name)
 	}
 
-	// check the model (must not have pgbouncer info)
-	model := getReport(o)
-	if model.PgBouncer != nil {
-		log.Fatal("use report-pgbouncer to send PgBouncer information")
+	// send the PgBouncer report from the same input, if asked to
+	if len(o.withPgb) > 0 {
+		reportWithPgBouncer(o, servers[0])
+		return
 	}
 
-	// call the api
-	_, err := client.Report(api.ReqReport{
-		APIKey: o.apiKey,
-		Server: args[0],
-		Data:   *model,
-	})
-	if errh, ok := err.(*api.RestV1ClientError); ok {
-		if errh.Code() == 400 {
-			log.Fatal("invalid API key or account limit reached")
+	// get the model (must not have pgbouncer info)
+	var model *pgmetrics.Model
+	var raw json.RawMessage
+	if o.raw {
+		raw = getRawReport(o, api.PayloadPostgres)
+	} else {
+		model = getReport(o, api.PayloadPostgres)
+	}
+
+	// call the api for each server
+	for _, server := range servers {
+		failure.Server = server
+		reportServer(o, server, model, raw)
+	}
+}
+
+// msg400Report is the message for HTTP status 400 from the report API.
+const msg400Report = "invalid API key or account limit reached"
+
+// reportTemplated sends the report under the name that --server-template
+// renders to for it.
+func reportTemplated(o options) {
+	var model *pgmetrics.Model
+	var raw json.RawMessage
+	if o.raw {
+		raw = getRawReport(o, api.PayloadPostgres)
+	} else {
+		model = getReport(o, api.PayloadPostgres)
+	}
+	server := checkServer(o, templateServerName(o, model, raw))
+	reportServer(o, server, model, raw)
+}
+
+// templateServerName returns the server name that --server-template renders to
+// for the model, or for the raw input in --raw mode.
+func templateServerName(o options, model *pgmetrics.Model, raw json.RawMessage) string {
+	if model == nil {
+		model = new(pgmetrics.Model)
+		if err := json.Unmarshal(raw, model); err != nil {
+			fatalCode(errCodeInvalidInput, "invalid input: %v", err)
 		}
-		if errh.Code() == 500 {
-			log.Fatal("internal server error")
+	}
+	var b strings.Builder
+	t := template.Must(template.New("server").Parse(o.srvTmpl)) // checked in parse()
+	if err := t.Execute(&b, model); err != nil {
+		fatalCode(errCodeInvalidInput, "failed to apply server template: %v", err)
+	}
+	name := strings.TrimSpace(b.String())
+	if len(name) == 0 {
+		fatalCode(errCodeInvalidInput, "server template gave an empty server name for this input")
+	}
+	if !api.RxServer.MatchString(name) {
+		fatalCode(errCodeInvalidInput, `server template gave %q, but server names must be 1-64 chars A-Z, a-z, 0-9, "-", "_", and ".".`, name)
+	}
+	if o.debug {
+		log.Printf("using server name %q from template", name)
+	}
+	return name
+}
+
+// roleMatches returns true if the server the report is from is a primary or a
+// replica as required by --only-if-primary or --only-if-replica, and logs why
+// the report is skipped if not.
+func roleMatches(o options, key string, model *pgmetrics.Model, raw json.RawMessage) bool {
+	if !o.onlyPrim && !o.onlyRepl {
+		return true
+	}
+	var replica bool
+	if model != nil {
+		replica = model.IsInRecovery
+	} else {
+		var peek struct {
+			IsInRecovery bool `json:"is_in_recovery"`
 		}
+		json.Unmarshal(raw, &peek) // already validated
+		replica = peek.IsInRecovery
 	}
-	if err != nil {
-		log.Fatalf("API request failed: %v", err)
+	if o.onlyPrim && replica {
+		log.Printf("%s: server is a replica, skipping due to --only-if-primary", key)
+		return false
+	} else if o.onlyRepl && !replica {
+		log.Printf("%s: server is not a replica, skipping due to --only-if-replica", key)
+		return false
+	}
+	return true
+}
+
+// reportServer reports the model, or the raw model if model is nil, under the
+// given server name. It returns false if the report was skipped, see
+// roleMatches and sendAll.
+func reportServer(o options, server string, model *pgmetrics.Model, raw json.RawMessage) bool {
+	if !roleMatches(o, "server="+server, model, raw) {
+		return false
+	}
+	return sendAll(o, msg400Report, reportTime(model, raw), payloadHash(o, model, raw), reportFunc(server, model, raw), "server="+server)
+}
+
+// reportFunc returns the function for sendAll that reports the model, or the
+// raw model if model is nil, under the given server name.
+func reportFunc(server string, model *pgmetrics.Model, raw json.RawMessage) func(c *api.RestV1Client, apiKey string) error {
+	return func(c *api.RestV1Client, apiKey string) (err error) {
+		if model == nil {
+			_, err = c.ReportRaw(api.ReqReportRaw{
+				APIKey: apiKey,
+				Server: server,
+				Data:   raw,
+			})
+		} else {
+			_, err = c.Report(api.ReqReport{
+				APIKey: apiKey,
+				Server: server,
+				Data:   *model,
+			})
+		}
+		return
+	}
+}
+
+// reportWithPgBouncer sends the input, which must have PgBouncer information,
+// both as the report for server without it and as the report for the
+// PgBouncer instance given with --with-pgbouncer. The PgBouncer report is
+// sent even if the first one fails, and pgdash exits with an error if either
+// failed.
+func reportWithPgBouncer(o options, server string) {
+	pgb := checkCase(o, "PgBouncer", o.withPgb)
+	failure.PgBouncer = pgb
+	model := getReport(o, api.PayloadPgBouncer)
+	if !roleMatches(o, "server="+server, model, nil) {
+		return
+	}
+	core := *model
+	core.PgBouncer = nil
+
+	_, err := trySendAll(o, msg400Report, core.Metadata.At, payloadHash(o, &core, nil), reportFunc(server, &core, nil), "server="+server)
+	if _, ok := err.(*destsError); err != nil && !ok {
+		log.Printf("server=%s: %s", server, apiErrorMessage(err, msg400Report))
+	}
+	msg400 := fmt.Sprintf("invalid API key or server %q not found", server)
+	_, pgbErr := trySendAll(o, msg400, model.Metadata.At, payloadHash(o, model, nil), reportPgBouncerFunc(server, pgb, model, nil),
+		"server="+server, "pgbouncer="+pgb)
+	checkSendError(pgbErr, msg400)
+	if e, ok := err.(*destsError); ok {
+		fatal(e)
+	} else if err != nil {
+		failure.code, failure.status = apiErrorCode(err)
+		die(exitCodeForError(err), "PostgreSQL report failed, PgBouncer report was sent")
 	}
 }
 
 func cmdReportPgBouncer(o options, args []string) {
 	// check API key
-	checkAPIKey(o)
+	checkAPIKey(&o)
 
 	// check args
 	if len(args) != 2 {
-		log.Fatal("invalid syntax for report-pgbouncer command, try --help for help.")
-	}
-	if !api.RxServer.MatchString(args[0]) {
-		log.Fatal(`bad server name, must be 1-64 chars A-Z, a-z, 0-9, "-", "_", and ".".`)
+		fatal("invalid syntax for report-pgbouncer command, try --help for help.")
 	}
+	server := checkServer(o, args[0])
+	failure.PgBouncer = args[1]
 	if !api.RxServer.MatchString(args[1]) {
-		log.Fatal(`bad PgBouncer name, must be 1-64 chars A-Z, a-z, 0-9, "-", "_", and ".".`)
+		fatal(`bad PgBouncer name, must be 1-64 chars A-Z, a-z, 0-9, "-", "_", and ".".`)
+	}
+	args[1] = checkCase(o, "PgBouncer", args[1])
+	failure.PgBouncer = args[1]
+	// compare as server names, so that the same name given twice is caught
+	// even when the prefix, suffix or lowercasing changed one of them
+	if server == checkCase(o, "PgBouncer", fullServerName(o, args[1])) {
+		if o.strict {
+			fatalf("server and PgBouncer names are both %q", server)
+		}
+		warnf("server and PgBouncer names are both %q, is this a mistake?", server)
 	}
 
-	// check the model (must have pgbouncer info)
-	model := getReport(o)
-	if model == nil || model.PgBouncer == nil {
-		log.Fatal("pgmetrics report does not contain PgBouncer information")
+	// get the model (must have pgbouncer info)
+	var model *pgmetrics.Model
+	var raw json.RawMessage
+	if o.raw {
+		raw = getRawReport(o, api.PayloadPgBouncer)
+	} else {
+		model = getReport(o, api.PayloadPgBouncer)
 	}
 
 	// call the api
-	_, err := client.ReportPgBouncer(api.ReqReportPgBouncer{
-		APIKey:    o.apiKey,
-		Server:    args[0],
-		PgBouncer: args[1],
-		Data:      *model,
-	})
-	if errh, ok := err.(*api.RestV1ClientError); ok {
-		if errh.Code() == 400 {
-			log.Fatalf("invalid API key or server %q not found", args[0])
-		}
-		if errh.Code() == 500 {
-			log.Fatal("internal server error")
+	msg400 := fmt.Sprintf("invalid API key or server %q not found", server)
+	sendAll(o, msg400, reportTime(model, raw), payloadHash(o, model, raw), reportPgBouncerFunc(server, args[1], model, raw),
+		"server="+server, "pgbouncer="+args[1])
+}
+
+// reportPgBouncerFunc returns the function for sendAll that reports the
+// model, or the raw model if model is nil, for the PgBouncer instance pgb
+// of server.
+func reportPgBouncerFunc(server, pgb string, model *pgmetrics.Model, raw json.RawMessage) func(c *api.RestV1Client, apiKey string) error {
+	return func(c *api.RestV1Client, apiKey string) (err error) {
+		if model == nil {
+			_, err = c.ReportPgBouncerRaw(api.ReqReportPgBouncerRaw{
+				APIKey:    apiKey,
+				Server:    server,
+				PgBouncer: pgb,
+				Data:      raw,
+			})
+		} else {
+			_, err = c.ReportPgBouncer(api.ReqReportPgBouncer{
+				APIKey:    apiKey,
+				Server:    server,
+				PgBouncer: pgb,
+				Data:      *model,
+			})
 		}
-	}
-	if err != nil {
-		log.Fatalf("API request failed: %v", err)
+		return
 	}
 }
 
 func cmdReportPgpool(o options, args []string) {
 	// check API key
-	checkAPIKey(o)
+	checkAPIKey(&o)
 
 	// check args
 	if len(args) == 0 {
-		log.Fatal("pgpool name needs to be specified, try --help for help.")
+		fatal("pgpool name needs to be specified, try --help for help.")
 	}
 	if len(args) != 1 {
-		log.Fatal("invalid syntax for report-pgpool command, try --help for help.")
+		fatal("invalid syntax for report-pgpool command, try --help for help.")
 	}
+	failure.Pgpool = args[0]
 	if !api.RxServer.MatchString(args[0]) {
-		log.Fatal(`bad pgpool name, must be 1-64 chars A-Z, a-z, 0-9, "-", "_", and ".".`)
+		fatal(`bad pgpool name, must be 1-64 chars A-Z, a-z, 0-9, "-", "_", and ".".`)
 	}
+	args[0] = checkCase(o, "Pgpool", args[0])
+	failure.Pgpool = args[0]
 
-	// check the model (must have pgbouncer info)
-	model := getReport(o)
-	if model == nil || model.Pgpool == nil {
-		log.Fatal("pgmetrics report does not contain Pgpool information")
+	// get the model (must have pgpool info)
+	var model *pgmetrics.Model
+	var raw json.RawMessage
+	if o.raw {
+		raw = getRawReport(o, api.PayloadPgpool)
+	} else {
+		model = getReport(o, api.PayloadPgpool)
 	}
 
 	// call the api
-	_, err := client.ReportPgpool(api.ReqReportPgpool{
-		APIKey: o.apiKey,
-		Pgpool: args[0],
-		Data:   *model,
-	})
-	if errh, ok := err.(*api.RestV1ClientError); ok {
-		if errh.Code() == 400 {
-			log.Fatalf("invalid API key or server %q not found", args[0])
-		}
-		if errh.Code() == 500 {
-			log.Fatal("internal server error")
+	msg400 := fmt.Sprintf("invalid API key or server %q not found", args[0])
+	sendAll(o, msg400, reportTime(model, raw), payloadHash(o, model, raw), func(c *api.RestV1Client, apiKey string) (err error) {
+		if model == nil {
+			_, err = c.ReportPgpoolRaw(api.ReqReportPgpoolRaw{
+				APIKey: apiKey,
+				Pgpool: args[0],
+				Data:   raw,
+			})
+		} else {
+			_, err = c.ReportPgpool(api.ReqReportPgpool{
+				APIKey: apiKey,
+				Pgpool: args[0],
+				Data:   *model,
+			})
 		}
-	}
-	if err != nil {
-		log.Fatalf("API request failed: %v", err)
-	}
+		return
+	}, "pgpool="+args[0])
 }
 
 func main() {
 	var o options
 	o.defaults()
 	args := o.parse()
-	command := args[0]
+	command := "connect"
+	if len(args) > 0 {
+		command = args[0]
+	}
 
 	log.SetPrefix("pgdash: ")
 	if o.debug {
@@ -384,17 +2111,118 @@ func main() {
 		log.SetFlags(0)
 	}
 
-	// create the client
+	// setup the failure webhook
+	failureURL = o.failureURL
+	failure.Command = command
+	outputJSON = o.output == "json"
+	summaryFile = o.summFile
+
+	if o.noTimeChk {
+		log.Print("warning: --no-time-check given, the collection time of the input will not be checked")
+	}
+
+	// take the lock, if asked to
+	if len(o.lockFile) > 0 {
+		if err := lockFile(o.lockFile); err == errLocked {
+			failure.code = errCodeLocked
+			die(exitLocked, fmt.Sprintf("another pgdash process holds the lock on %s", o.lockFile))
+		} else if err != nil {
+			fatalf("failed to lock %s: %v", o.lockFile, err)
+		}
+	}
+
+	// create the client(s)
+	client = newClient(o, o.baseURL)
+	for i := range o.dests {
+		o.dests[i].client = newClient(o, o.dests[i].baseURL)
+	}
+
+	// wait for the network to come up, if asked to
+	if strings.HasPrefix(command, "report") || command == "bench" {
+		waitForNetwork(o)
+	}
+
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	run := func() {
+		failure = failureEvent{Command: command}
+
+		// skip reporting, if sampling says so
+		if strings.HasPrefix(command, "report") && o.sampleRate < 1 {
+			if rng.Float64() >= o.sampleRate {
+				log.Print("skipped by sampling")
+				return
+			}
+		}
+
+		warnings = 0
+		runCommand(o, command, args)
+		if o.failOnWarn && warnings > 0 {
+			fatalf("%d warning(s) logged, failing due to --fail-on-warnings", warnings)
+		}
+	}
+	if o.watch > 0 {
+		watch(o, run)
+	} else {
+		run()
+	}
+}
+
+// newClient creates a client for the given base URL, configured as per the
+// options.
+func newClient(o options, baseURL string) *api.RestV1Client {
 	tout := time.Duration(o.timeoutSec) * time.Second
-	client = api.NewRestV1Client(o.baseURL, tout, int(o.retries))
-	client.SetDebug(o.debug)
+	c := api.NewRestV1Client(baseURL, tout, int(o.retries))
+	c.SetDebug(o.debug)
+	c.SetTrace(o.trace)
+	c.SetMinThroughput(int(o.minBPS))
+	c.SetMaxResponseSize(int64(o.maxResp))
+	c.SetStreaming(o.stream)
+	c.SetDumpOnError(o.dumpOnErr)
+	c.SetDumpCurl(o.dumpCurl || o.curlAll, o.curlAll)
+	c.SetRetryAfterLimits(o.raMin, o.raMax)
+	c.SetRetryOnTimeout(o.retryTout)
+	c.SetPreferredFamily(o.prefer)
+	c.SetFollowRedirects(!o.noRedir)
+	c.SetNoProxy(o.noProxy)
+	if o.backoffSet {
+		c.SetBackoffSeed(o.backoffSd)
+	}
+	if len(o.httpUser) > 0 {
+		c.SetBasicAuth(o.httpUser, o.httpPass)
+	}
+	if len(o.signKey) > 0 {
+		c.SetSigningKey([]byte(o.signKey), o.signHdr)
+	}
+	c.SetContentMD5(o.contMD5)
+	c.SetAttemptObserver(self.observe)
+	return c
+}
 
+func runCommand(o options, command string, args []string) {
 	switch command {
+	case "connect":
+		cmdConnect(o)
 	case "report":
 		cmdReport(o, args[1:])
 	case "report-pgbouncer":
 		cmdReportPgBouncer(o, args[1:])
 	case "report-pgpool":
 		cmdReportPgpool(o, args[1:])
+	case "diff":
+		cmdDiff(o, args[1:])
+	case "stats":
+		cmdStats(o, args[1:])
+	case "list-sections":
+		cmdListSections(args[1:])
+	case "describe":
+		cmdDescribe(o, args[1:])
+	case "bench":
+		cmdBench(o, args[1:])
+	case "echo-server":
+		cmdEchoServer(o, args[1:])
+	case "set-key":
+		cmdSetKey(o, args[1:])
+	case "delete-key":
+		cmdDeleteKey(o, args[1:])
 	}
 }
@@ -0,0 +1,114 @@
+//go:build !windows
+
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rapidloop/pgmetrics"
+)
+
+// TestReadFile reads a regular file and a FIFO, which reports a size of zero,
+// with readFile.
+func TestReadFile(t *testing.T) {
+	want := []byte(strings.Repeat(`{"meta":{"version":"1.17.0"}}`, 10000))
+	for _, tc := range []struct {
+		name  string
+		setup func(t *testing.T, name string)
+	}{
+		{"regular", func(t *testing.T, name string) {
+			if err := os.WriteFile(name, want, 0600); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{"fifo", func(t *testing.T, name string) {
+			if err := syscall.Mkfifo(name, 0600); err != nil {
+				t.Skipf("mkfifo: %v", err)
+			}
+			go func() {
+				// blocks until readFile opens the FIFO for reading
+				f, err := os.OpenFile(name, os.O_WRONLY, 0)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				defer f.Close()
+				if _, err := f.Write(want); err != nil {
+					t.Error(err)
+				}
+			}()
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			name := filepath.Join(t.TempDir(), "input.json")
+			tc.setup(t, name)
+			got, err := readFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("read %d bytes, want %d", len(got), len(want))
+			}
+		})
+	}
+}
+
+// TestPrepareEntryTransformFails runs a --transform command that fails for
+// one of the entries of a batch, which must be an error for that entry only.
+func TestPrepareEntryTransformFails(t *testing.T) {
+	o := options{
+		transform: `in=$(cat); case "$in" in *'"name":"bad"'*) exit 1;; esac; printf '%s' "$in"`,
+		transTout: 10 * time.Second,
+		noTimeChk: true,
+	}
+	var failed int
+	for _, db := range []string{"db1", "bad", "db2"} {
+		var m pgmetrics.Model
+		m.Metadata.Version = "1.17.0"
+		m.Metadata.At = 1700000000
+		m.Databases = []pgmetrics.Database{{Name: db}}
+		data, err := json.Marshal(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		model, _, err := prepareEntry(o, data)
+		if db == "bad" {
+			if err == nil || !strings.Contains(err.Error(), "transform: command failed") {
+				t.Errorf("%s: got error %v, want transform failure", db, err)
+			}
+			failed++
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", db, err)
+		} else if got := model.Databases[0].Name; got != db {
+			t.Errorf("%s: transformed model has database %q", db, got)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("%d entries failed, want 1", failed)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/rapidloop/pgdash/api"
+)
+
+// docHostname returns the hostname in the system metrics of the JSON-encoded
+// pgmetrics model, or an empty string if there is none.
+func docHostname(data []byte) string {
+	var peek struct {
+		System *struct {
+			Hostname string `json:"hostname"`
+		} `json:"system"`
+	}
+	if json.Unmarshal(data, &peek) != nil || peek.System == nil {
+		return ""
+	}
+	return peek.System.Hostname
+}
+
+// reportDocs sends a report for each of the JSON documents in the input,
+// which are one after the other, with only optional whitespace in between.
+// Each is reported under the server name given, if any, or else under the
+// hostname in the document. Documents that are not valid reports are skipped
+// with a warning, and make pgdash exit with an error at the end. API errors
+// are fatal as usual.
+func reportDocs(o options, args []string) {
+	if len(args) > 1 {
+		fatal("invalid syntax for report command, at most one server name can be given with --multi-doc.")
+	}
+	var server string
+	if len(args) == 1 {
+		server = checkServer(o, args[0])
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(readInput(o)))
+	var sent, skipped, failed int
+	for n := 1; ; n++ {
+		var data json.RawMessage
+		if err := dec.Decode(&data); err == io.EOF {
+			break
+		} else if err != nil {
+			// the rest of the input cannot be decoded after a syntax error
+			fatalCode(errCodeInvalidInput, "document %d: invalid input: %v", n, err)
+		}
+		name := server
+		if len(name) == 0 {
+			if name = docHostname(data); len(name) == 0 {
+				warnf("document %d: no server name given and no hostname in input, skipping", n)
+				failed++
+				continue
+			}
+			name = fullServerName(o, name)
+			if !api.RxServer.MatchString(name) {
+				warnf("document %d: bad server name %q, skipping", n, name)
+				failed++
+				continue
+			}
+			if o.strictCase && name != strings.ToLower(name) {
+				warnf("document %d: server name %q is not in lowercase, skipping", n, name)
+				failed++
+				continue
+			}
+			name = checkCase(o, "server", name)
+		}
+		model, raw, err := prepareEntry(o, data)
+		if err != nil {
+			warnf("document %d: invalid input: %v, skipping", n, err)
+			failed++
+			continue
+		}
+		failure.Server = name
+		if reportServer(o, name, model, raw) {
+			sent++
+		} else {
+			skipped++
+		}
+	}
+	failure.Server = ""
+
+	if !o.quiet {
+		fmt.Printf("documents sent=%d skipped=%d failed=%d\n", sent, skipped, failed)
+	}
+	if failed > 0 {
+		fatalCode(errCodeInvalidInput, "%d of %d documents could not be sent", failed, sent+skipped+failed)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReportDocs(t *testing.T) {
+	docs := `{"meta":{"version":"1.17.0","at":1},"system":{"hostname":"db1"}}
+{"meta":{"version":"1.17.0","at":2},"system":{"hostname":"Db2"}}
+{"meta":{"version":"1.17.0","at":3},"system":{"hostname":"db3"},"is_in_recovery":true}
+{"meta":{"version":"1.17.0","at":4},"system":{"hostname":"db4"}}
+`
+	o := options{
+		input:      filepath.Join(t.TempDir(), "docs.json"),
+		dryRun:     true,
+		noTimeChk:  true,
+		onlyPrim:   true,
+		strictCase: true,
+	}
+	if err := os.WriteFile(o.input, []byte(docs), 0600); err != nil {
+		t.Fatal(err)
+	}
+	stdout, logs, code := runBatch(t, func() { reportDocs(o, nil) })
+
+	for _, want := range []string{
+		"ok server=db1 (dry run)",
+		"ok server=db4 (dry run)",
+		"documents sent=2 skipped=1 failed=1",
+	} {
+		if !strings.Contains(stdout, want) {
+			t.Errorf("output does not have %q:\n%s", want, stdout)
+		}
+	}
+	if !strings.Contains(logs, `document 2: server name "Db2" is not in lowercase, skipping`) {
+		t.Errorf("log does not mention the mixed-case name:\n%s", logs)
+	}
+	if code != 1 {
+		t.Errorf("exit code %d, want 1", code)
+	}
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/rapidloop/pgmetrics"
+)
+
+// normalizeQueries collapses the whitespace in the text of the queries in the
+// model, if --normalize-whitespace-queries was given, so that queries that
+// differ only in formatting group together.
+func normalizeQueries(o options, model *pgmetrics.Model) {
+	if !o.normQuery {
+		return
+	}
+	var n int
+	norm := func(q *string) {
+		if t := normalizeWhitespace(*q); t != *q {
+			*q = t
+			n++
+		}
+	}
+	for i := range model.Backends {
+		norm(&model.Backends[i].Query)
+	}
+	for i := range model.Statements {
+		norm(&model.Statements[i].Query)
+	}
+	for i := range model.Plans {
+		norm(&model.Plans[i].Query)
+	}
+	if o.debug && n > 0 {
+		log.Printf("normalized whitespace in %d queries", n)
+	}
+}
+
+// rxDollarTag matches the opening tag of a dollar-quoted string, like $$ or
+// $body$.
+var rxDollarTag = regexp.MustCompile(`^\$([A-Za-z_\x80-\xff][A-Za-z0-9_\x80-\xff]*)?\$`)
+
+// normalizeWhitespace trims the SQL text q and replaces each run of whitespace
+// in it with a single space. Quoted strings and identifiers, dollar-quoted
+// strings and comments are kept as they are, and a line comment is still
+// followed by a newline so that it does not swallow the rest of the query.
+// Unterminated quotes or comments are kept up to the end of q.
+func normalizeWhitespace(q string) string {
+	var b strings.Builder
+	b.Grow(len(q))
+	for i := 0; i < len(q); {
+		c := q[i]
+		var end int
+		switch {
+		case isSpace(c):
+			j := i
+			for j < len(q) && isSpace(q[j]) {
+				j++
+			}
+			if b.Len() > 0 && j < len(q) {
+				b.WriteByte(' ')
+			}
+			i = j
+			continue
+		case c == '\'':
+			// E'...' strings can have backslash escapes
+			esc := i > 0 && (q[i-1] == 'e' || q[i-1] == 'E') && (i < 2 || !isIdentChar(q[i-2]))
+			end = quoteEnd(q, i, '\'', esc)
+		case c == '"':
+			end = quoteEnd(q, i, '"', false)
+		case c == '$' && (i == 0 || !isIdentChar(q[i-1])) && rxDollarTag.MatchString(q[i:]):
+			tag := rxDollarTag.FindString(q[i:])
+			if k := strings.Index(q[i+len(tag):], tag); k >= 0 {
+				end = i + len(tag) + k + len(tag)
+			} else {
+				end = len(q)
+			}
+		case strings.HasPrefix(q[i:], "--"):
+			end = len(q)
+			if k := strings.IndexByte(q[i:], '\n'); k >= 0 {
+				end = i + k
+			}
+			b.WriteString(q[i:end])
+			// keep the comment on its own line
+			j := end
+			for j < len(q) && isSpace(q[j]) {
+				j++
+			}
+			if j < len(q) {
+				b.WriteByte('\n')
+			}
+			i = j
+			continue
+		case strings.HasPrefix(q[i:], "/*"):
+			end = blockCommentEnd(q, i)
+		default:
+			end = i + 1
+		}
+		b.WriteString(q[i:end])
+		i = end
+	}
+	return b.String()
+}
+
+// quoteEnd returns the index just past the quote character that closes the
+// quoted text starting at q[start]. Doubled quotes, and backslash escapes if
+// esc is set, do not close it.
+func quoteEnd(q string, start int, quote byte, esc bool) int {
+	for k := start + 1; k < len(q); k++ {
+		switch {
+		case esc && q[k] == '\\':
+			k++
+		case q[k] == quote:
+			if k+1 < len(q) && q[k+1] == quote {
+				k++
+				continue
+			}
+			return k + 1
+		}
+	}
+	return len(q)
+}
+
+// blockCommentEnd returns the index just past the end of the block comment
+// starting at q[start]. Block comments nest in PostgreSQL.
+func blockCommentEnd(q string, start int) int {
+	depth := 0
+	for k := start; k+1 < len(q); k++ {
+		switch {
+		case q[k] == '/' && q[k+1] == '*':
+			depth++
+			k++
+		case q[k] == '*' && q[k+1] == '/':
+			depth--
+			k++
+			if depth == 0 {
+				return k + 1
+			}
+		}
+	}
+	return len(q)
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 0x80 ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
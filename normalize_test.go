@@ -0,0 +1,80 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import "testing"
+
+func TestNormalizeWhitespace(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"empty", "", ""},
+		{"blank", " \t\n ", ""},
+		{"collapse and trim", "  SELECT\n\t a,   b\r\n FROM t  ", "SELECT a, b FROM t"},
+		{"string", "select 'a  b'   from t", "select 'a  b' from t"},
+		{"doubled quotes", "select 'it''s   x' ,  ''   ,  ''''", "select 'it''s   x' , '' , ''''"},
+		{"E string", `select E'it\'s  x'   from t`, `select E'it\'s  x' from t`},
+		{"e string escaped backslash", `select e'a\\'  ,  'b  c'`, `select e'a\\' , 'b  c'`},
+		{"backslash in plain string", `select 'a\'  ,  'b  c'`, `select 'a\' , 'b  c'`},
+		{"identifier ending in e", `select name'x  y'`, `select name'x  y'`},
+		{"quoted identifier", `select "quoted  ident"   from  "t""  x"`, `select "quoted  ident" from "t""  x"`},
+		{"dollar quotes", "select $$a   b$$  ,  1", "select $$a   b$$ , 1"},
+		{"tagged dollar quotes", "create function f() as $fn$ select  $$ x  $$ ;  $fn$   language sql",
+			"create function f() as $fn$ select  $$ x  $$ ;  $fn$ language sql"},
+		{"parameters", "select $1  ,  $2", "select $1 , $2"},
+		{"dollar in identifier", "select a$b   from t", "select a$b from t"},
+		{"unterminated string", "select 'abc   def", "select 'abc   def"},
+		{"unterminated identifier", `select "abc   def`, `select "abc   def`},
+		{"unterminated dollar quote", "select $x$ a   b", "select $x$ a   b"},
+		{"line comment", "select 1 -- one   two\n   from t", "select 1 -- one   two\nfrom t"},
+		{"line comment at end", "select 1 --  done  ", "select 1 --  done  "},
+		{"block comment", "select /* a   b */   1", "select /* a   b */ 1"},
+		{"nested block comment", "select /* a /* b   */  c */   1", "select /* a /* b   */  c */ 1"},
+		{"unterminated block comment", "select /* a   b", "select /* a   b"},
+		{"operators", "a-b   /  c * d", "a-b / c * d"},
+		{"multibyte", "select ' é  '   ,  ü", "select ' é  ' , ü"},
+	}
+	for _, tt := range tests {
+		if got := normalizeWhitespace(tt.in); got != tt.want {
+			t.Errorf("%s: normalizeWhitespace(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteEnd(t *testing.T) {
+	tests := []struct {
+		in    string
+		quote byte
+		esc   bool
+		want  int
+	}{
+		{"'ab' x", '\'', false, 4},
+		{"'' x", '\'', false, 2},
+		{"'a''b' x", '\'', false, 6},
+		{`'a\'b' x`, '\'', false, 4},
+		{`'a\'b' x`, '\'', true, 6},
+		{`'a\\' x`, '\'', true, 5},
+		{`"a""b" x`, '"', false, 6},
+		{"'abc", '\'', false, 4},
+		{`'abc\`, '\'', true, 5},
+	}
+	for _, tt := range tests {
+		if got := quoteEnd(tt.in, 0, tt.quote, tt.esc); got != tt.want {
+			t.Errorf("quoteEnd(%q, esc=%v) = %d, want %d", tt.in, tt.esc, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rapidloop/pgdash/api"
+)
+
+// Error codes, for the errorCode field of --output=json. These are stable
+// across versions, see README.md.
+const (
+	errCodeAuth         = "AUTH"          // API key missing, invalid or rejected
+	errCodeRateLimit    = "RATE_LIMIT"    // server returned HTTP 429
+	errCodeNetwork      = "NETWORK"       // could not connect, or timed out
+	errCodeDNS          = "DNS"           // could not resolve the host
+	errCodeInvalidInput = "INVALID_INPUT" // input could not be read or is not acceptable
+	errCodeServer       = "SERVER"        // server or gateway returned HTTP 5xx
+	errCodeLocked       = "LOCKED"        // lock file held by another pgdash
+	errCodeOther        = "ERROR"         // anything else
+)
+
+// outputJSON is set with --output=json.
+var outputJSON bool
+
+// summaryFile is the file given with --summary-file.
+var summaryFile string
+
+// jsonResult is the JSON object printed for each report with --output=json,
+// in place of the summary line on success and in addition to the logged
+// message on failure.
+type jsonResult struct {
+	OK         bool   `json:"ok"`
+	Command    string `json:"command"`
+	Dest       int    `json:"dest,omitempty"`
+	Server     string `json:"server,omitempty"`
+	PgBouncer  string `json:"pgbouncer,omitempty"`
+	Pgpool     string `json:"pgpool,omitempty"`
+	Bytes      int    `json:"bytes,omitempty"`
+	Attempts   int    `json:"attempts,omitempty"`
+	DurationMS int64  `json:"durationMs,omitempty"`
+	DryRun     bool   `json:"dryRun,omitempty"`
+	Error      string `json:"error,omitempty"`
+	ErrorCode  string `json:"errorCode,omitempty"`
+	Status     int    `json:"status,omitempty"`
+}
+
+// setNames fills in r from names like "server=NAME", as passed to
+// printSummary.
+func (r *jsonResult) setNames(names []string) {
+	for _, n := range names {
+		k, v, _ := strings.Cut(n, "=")
+		switch k {
+		case "dest":
+			r.Dest, _ = strconv.Atoi(v)
+		case "server":
+			r.Server = v
+		case "pgbouncer":
+			r.PgBouncer = v
+		case "pgpool":
+			r.Pgpool = v
+		}
+	}
+}
+
+// printJSON prints r as a single line of JSON to stdout.
+func printJSON(r jsonResult) {
+	json.NewEncoder(os.Stdout).Encode(r)
+}
+
+// summaryLine is a line of the --summary-file.
+type summaryLine struct {
+	Timestamp string `json:"timestamp"`
+	jsonResult
+}
+
+// appendSummary appends r as a line of JSON to the --summary-file, if one was
+// given. Errors are logged and otherwise ignored.
+func appendSummary(r jsonResult) {
+	if len(summaryFile) == 0 {
+		return
+	}
+	line, err := json.Marshal(summaryLine{time.Now().UTC().Format(time.RFC3339), r})
+	if err == nil {
+		err = appendLocked(summaryFile, append(line, '\n'))
+	}
+	if err != nil {
+		log.Printf("warning: failed to write to summary file: %v", err)
+	}
+}
+
+// failureResult returns the result for the failure with the given message.
+func failureResult(msg string) jsonResult {
+	code := failure.code
+	if len(code) == 0 {
+		code = errCodeOther
+	}
+	return jsonResult{
+		Command:   failure.Command,
+		Server:    failure.Server,
+		PgBouncer: failure.PgBouncer,
+		Pgpool:    failure.Pgpool,
+		Error:     msg,
+		ErrorCode: code,
+		Status:    failure.status,
+	}
+}
+
+// apiErrorCode returns the error code and HTTP status, if any, for err,
+// returned from an API call.
+func apiErrorCode(err error) (string, int) {
+	if errh, ok := err.(*api.RestV1ClientError); ok {
+		switch {
+		case errh.Code() == 400 || errh.Code() == 401 || errh.Code() == 403:
+			return errCodeAuth, errh.Code()
+		case errh.Code() == 429:
+			return errCodeRateLimit, errh.Code()
+		case errh.Code() >= 500:
+			return errCodeServer, errh.Code()
+		}
+		return errCodeOther, errh.Code()
+	}
+	var errd *net.DNSError
+	if errors.As(err, &errd) {
+		return errCodeDNS, 0
+	}
+	var errn net.Error
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.As(err, &errn) {
+		return errCodeNetwork, 0
+	}
+	return errCodeOther, 0
+}
@@ -0,0 +1,124 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/rapidloop/pgdash/api"
+)
+
+// selfCounts are the counts kept by selfStats.
+type selfCounts struct {
+	runs     int64
+	failures int64
+	failRun  int64         // consecutive failures, since the last success
+	retries  int64         // attempts of API calls that were retried
+	attempt  int           // of the current or last API call
+	backoff  time.Duration // before the next attempt, 0 if not retrying
+	avg      time.Duration // time taken by a run, see get
+}
+
+// selfStats counts the runs made with --watch, and the attempts of the API
+// calls made in them, for --report-interval-metrics and the /metrics page of
+// --health-endpoint.
+type selfStats struct {
+	mu    sync.Mutex
+	c     selfCounts
+	total time.Duration // time taken by all runs
+}
+
+var self selfStats
+
+// record counts a run that took d, and succeeded if ok.
+func (s *selfStats) record(ok bool, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.c.runs++
+	s.total += d
+	if ok {
+		s.c.failRun = 0
+	} else {
+		s.c.failures++
+		s.c.failRun++
+	}
+}
+
+// observe records the outcome of an attempt of an API call, as the client's
+// attempt observer.
+func (s *selfStats) observe(a api.Attempt) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.c.attempt = a.N
+	s.c.backoff = 0
+	if a.Retry {
+		s.c.retries++
+		s.c.backoff = a.Delay
+	}
+}
+
+// get returns the counts, with the average time taken by a run.
+func (s *selfStats) get() selfCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.c
+	if c.runs > 0 {
+		c.avg = s.total / time.Duration(c.runs)
+	}
+	return c
+}
+
+// lastSuccessText returns the time of the last successful run, or "never".
+func lastSuccessText() string {
+	if last := lastSuccess.Load(); last > 0 {
+		return time.Unix(0, last).UTC().Format(time.RFC3339)
+	}
+	return "never"
+}
+
+// logSelfStats logs a line with the counts every --report-interval-metrics,
+// forever.
+func logSelfStats(every time.Duration) {
+	for range time.Tick(every) {
+		c := self.get()
+		log.Printf("stats: runs=%d failed=%d consecutive_failures=%d last_success=%s avg_duration=%v attempt=%d backoff=%v retries=%d",
+			c.runs, c.failures, c.failRun, lastSuccessText(), c.avg.Round(time.Millisecond),
+			c.attempt, c.backoff.Round(time.Millisecond), c.retries)
+	}
+}
+
+// writeMetrics writes the counts in the Prometheus text format.
+func writeMetrics(w io.Writer) {
+	c := self.get()
+	metric := func(name, typ, help string, v interface{}) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, v)
+	}
+	metric("pgdash_runs_total", "counter", "Number of --watch runs made.", c.runs)
+	metric("pgdash_run_failures_total", "counter", "Number of --watch runs that failed.", c.failures)
+	metric("pgdash_consecutive_failures", "gauge", "Number of runs that failed since the last successful one.", c.failRun)
+	metric("pgdash_last_success_timestamp_seconds", "gauge", "Time of the last successful run, 0 if none.",
+		lastSuccess.Load()/int64(time.Second))
+	metric("pgdash_run_duration_seconds_avg", "gauge", "Average time taken by a run.", c.avg.Seconds())
+	metric("pgdash_api_call_attempt", "gauge", "Attempt number of the current or last API call, 0 if none.", c.attempt)
+	metric("pgdash_api_retry_backoff_seconds", "gauge", "Delay before the next attempt of the current API call, 0 if not retrying.",
+		c.backoff.Seconds())
+	metric("pgdash_api_retries_total", "counter", "Number of API call attempts that were retried.", c.retries)
+}
@@ -0,0 +1,83 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rapidloop/pgdash/api"
+)
+
+// noSleepClock is an api.Clock that calls onSleep instead of waiting.
+type noSleepClock struct {
+	onSleep func()
+}
+
+func (noSleepClock) Now() time.Time { return time.Now() }
+
+func (c noSleepClock) Sleep(ctx context.Context, d time.Duration) error {
+	c.onSleep()
+	return ctx.Err()
+}
+
+func TestSelfStatsRetries(t *testing.T) {
+	self.c = selfCounts{}
+	defer func() { self.c = selfCounts{} }()
+
+	// fails once, then succeeds
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer srv.Close()
+
+	var o options
+	o.defaults()
+	c := newClient(o, srv.URL+"/api/v1")
+	var during selfCounts
+	c.SetClock(noSleepClock{onSleep: func() { during = self.get() }})
+	if _, err := c.Report(api.ReqReport{APIKey: "key", Server: "db1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if during.attempt != 1 || during.backoff <= 0 || during.retries != 1 {
+		t.Errorf("while backing off: attempt=%d backoff=%v retries=%d, want 1, >0 and 1",
+			during.attempt, during.backoff, during.retries)
+	}
+	var buf bytes.Buffer
+	writeMetrics(&buf)
+	for _, want := range []string{
+		"\npgdash_api_call_attempt 2\n",
+		"\npgdash_api_retry_backoff_seconds 0\n",
+		"\npgdash_api_retries_total 1\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics do not have %q:\n%s", strings.TrimSpace(want), buf.String())
+		}
+	}
+}
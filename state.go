@@ -0,0 +1,261 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/rapidloop/pgmetrics"
+)
+
+// stateVersion is the version of the format of the state file.
+const stateVersion = 1
+
+// state is what pgdash remembers between runs, kept as JSON in the file
+// state.json (or state.json.gz, with --compress-state) in --state-dir. See
+// README.md for the format.
+type state struct {
+	Version int                     `json:"version"`
+	Servers map[string]*serverState `json:"servers"`
+}
+
+// serverState is the state for one server, keyed like "server=NAME" or
+// "server=NAME pgbouncer=NAME".
+type serverState struct {
+	// LastSentAt is the time the last report sent successfully was collected,
+	// for --only-if-newer.
+	LastSentAt int64 `json:"last_sent_at,omitempty"`
+	// LastHash is the hash of the last report sent successfully, and
+	// LastSentTime the time it was sent, for --dedupe-window.
+	LastHash     string `json:"last_hash,omitempty"`
+	LastSentTime int64  `json:"last_sent_time,omitempty"`
+}
+
+// statePaths returns the path of the state file to write, and of the one
+// with the other compression, which is read if the first does not exist.
+func statePaths(o options) (string, string) {
+	plain := filepath.Join(o.stateDir, "state.json")
+	if o.stateGz {
+		return plain + ".gz", plain
+	}
+	return plain, plain + ".gz"
+}
+
+// server returns the state for key, creating it if needed.
+func (s *state) server(key string) *serverState {
+	if s.Servers == nil {
+		s.Servers = make(map[string]*serverState)
+	}
+	ss, ok := s.Servers[key]
+	if !ok {
+		ss = &serverState{}
+		s.Servers[key] = ss
+	}
+	return ss
+}
+
+// loadState reads the state file from --state-dir. A missing file is not an
+// error, and gives an empty state.
+func loadState(o options) (*state, error) {
+	name, other := statePaths(o)
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = os.Open(other)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return &state{Version: stateVersion}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var r io.Reader = bufio.NewReader(f)
+	if magic, _ := r.(*bufio.Reader).Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		if r, err = gzip.NewReader(r); err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Name(), err)
+		}
+	}
+	var s state
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return nil, fmt.Errorf("%s: %v", f.Name(), err)
+	}
+	if s.Version != stateVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d", f.Name(), s.Version)
+	}
+	return &s, nil
+}
+
+// saveState writes the state file into --state-dir, creating the directory if
+// needed. It is written to a temporary file first and then renamed, so that
+// it is never left partly written.
+func saveState(o options, s *state) error {
+	if err := os.MkdirAll(o.stateDir, 0700); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if o.stateGz {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(s); err != nil {
+		return err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+
+	name, other := statePaths(o)
+	f, err := os.CreateTemp(o.stateDir, ".state-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	os.Remove(other) // from before --compress-state was changed, if any
+	return nil
+}
+
+// updateState loads the state, calls fn to change it, and saves it. Errors
+// are logged as warnings, as the report has been sent already.
+func updateState(o options, fn func(s *state)) {
+	s, err := loadState(o)
+	if err == nil {
+		fn(s)
+		err = saveState(o, s)
+	}
+	if err != nil {
+		warnf("failed to update state in %s: %v", o.stateDir, err)
+	}
+}
+
+// reportTime returns the time at which the report was collected, from its
+// metadata, as seconds since the epoch. raw is used if model is nil.
+func reportTime(model *pgmetrics.Model, raw json.RawMessage) int64 {
+	if model != nil {
+		return model.Metadata.At
+	}
+	var peek struct {
+		Metadata pgmetrics.Metadata `json:"meta"`
+	}
+	json.Unmarshal(raw, &peek) // already validated
+	return peek.Metadata.At
+}
+
+// isNewer returns false if --only-if-newer was given and a report collected
+// after at has already been sent under key.
+func isNewer(o options, key string, at int64) bool {
+	if !o.onlyNewer {
+		return true
+	}
+	s, err := loadState(o)
+	if err != nil {
+		fatalf("failed to read state: %v", err)
+	}
+	if ss, ok := s.Servers[key]; ok && at < ss.LastSentAt {
+		log.Printf("%s: report collected at %d is older than last sent (%d), skipping",
+			key, at, ss.LastSentAt)
+		return false
+	}
+	return true
+}
+
+// payloadHash returns the hash of the report, the model or raw if model is
+// nil, for --dedupe-window. It returns an empty string if --dedupe-window was
+// not given.
+func payloadHash(o options, model *pgmetrics.Model, raw json.RawMessage) string {
+	if o.dedupe <= 0 {
+		return ""
+	}
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	if model != nil {
+		enc.Encode(model)
+	} else {
+		h.Write(raw)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// isDuplicate returns true if --dedupe-window was given, and a report with
+// the same hash was sent under key within that window, unless --force was
+// given.
+func isDuplicate(o options, key, hash string) bool {
+	if o.dedupe <= 0 || o.force || len(hash) == 0 {
+		return false
+	}
+	s, err := loadState(o)
+	if err != nil {
+		fatalf("failed to read state: %v", err)
+	}
+	ss, ok := s.Servers[key]
+	if !ok || ss.LastHash != hash {
+		return false
+	}
+	ago := time.Since(time.Unix(ss.LastSentTime, 0))
+	if ago < 0 || ago >= o.dedupe {
+		return false
+	}
+	log.Printf("%s: identical report already sent %v ago, skipping (use --force to send it anyway)",
+		key, ago.Round(time.Second))
+	return true
+}
+
+// recordSent records that a report collected at at, and with the given hash,
+// was sent under key, if --only-if-newer or --dedupe-window was given.
+func recordSent(o options, key string, at int64, hash string) {
+	if !o.onlyNewer && len(hash) == 0 {
+		return
+	}
+	updateState(o, func(s *state) {
+		ss := s.server(key)
+		if o.onlyNewer {
+			ss.LastSentAt = at
+		}
+		if len(hash) > 0 {
+			ss.LastHash = hash
+			ss.LastSentTime = time.Now().Unix()
+		}
+	})
+}
@@ -0,0 +1,138 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/rapidloop/pgmetrics"
+)
+
+func cmdStats(o options, args []string) {
+	if len(args) != 1 {
+		fatal("invalid syntax for stats command, try --help for help.")
+	}
+	m := loadModel(o, args[0])
+
+	// server
+	at := time.Unix(m.Metadata.At, 0)
+	fmt.Printf("collected at:     %s\n", at.Format(time.RFC3339))
+	if v, ok := m.Settings["server_version"]; ok {
+		fmt.Printf("version:          %s\n", v.Setting)
+	}
+	if m.StartTime > 0 {
+		fmt.Printf("uptime:           %v\n", at.Sub(time.Unix(m.StartTime, 0)))
+	}
+	fmt.Printf("in recovery:      %v\n", m.IsInRecovery)
+
+	// connections, by state
+	states := make(map[string]int)
+	for _, b := range m.Backends {
+		states[b.State]++
+	}
+	fmt.Printf("connections:      %d%s\n", len(m.Backends), fmtCounts(states))
+
+	statsDatabases(m)
+	statsReplication(m)
+	statsStatements(m)
+
+	// other sections
+	if m.PgBouncer != nil {
+		fmt.Printf("pgbouncer:        %d pools\n", len(m.PgBouncer.Pools))
+	}
+	if m.Pgpool != nil {
+		fmt.Printf("pgpool:           %d backends\n", len(m.Pgpool.Backends))
+	}
+}
+
+// fmtCounts returns the counts like " (active=2, idle=5)", sorted by key, or
+// an empty string if there are none.
+func fmtCounts(counts map[string]int) string {
+	if len(counts) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	s := " ("
+	for i, k := range keys {
+		if i > 0 {
+			s += ", "
+		}
+		if len(k) == 0 {
+			s += fmt.Sprintf("unknown=%d", counts[k])
+		} else {
+			s += fmt.Sprintf("%s=%d", k, counts[k])
+		}
+	}
+	return s + ")"
+}
+
+func statsDatabases(m *pgmetrics.Model) {
+	if len(m.Databases) == 0 {
+		return
+	}
+	var total int64
+	for _, d := range m.Databases {
+		if d.Size > 0 {
+			total += d.Size
+		}
+	}
+	fmt.Printf("databases:        %d, total %s\n", len(m.Databases), fmtBytes(total))
+	for _, d := range m.Databases {
+		fmt.Printf("  %-30s %12s %5d connections\n", d.Name, fmtBytes(d.Size), d.NumBackends)
+	}
+}
+
+func statsReplication(m *pgmetrics.Model) {
+	if r := m.ReplicationIncoming; r != nil {
+		fmt.Printf("replicating from: %s (%s, latency %v)\n", r.SenderHost, r.Status,
+			time.Duration(r.Latency)*time.Microsecond)
+	}
+	if len(m.ReplicationOutgoing) == 0 {
+		return
+	}
+	fmt.Println("replicas (replay lag in seconds):")
+	for _, r := range m.ReplicationOutgoing {
+		name := r.ApplicationName
+		if len(name) == 0 {
+			name = r.ClientAddr
+		}
+		fmt.Printf("  %-30s %-12s %d\n", name, r.State, r.ReplayLag)
+	}
+}
+
+func statsStatements(m *pgmetrics.Model) {
+	if len(m.Statements) == 0 {
+		return
+	}
+	top := make([]pgmetrics.Statement, len(m.Statements))
+	copy(top, m.Statements)
+	sort.Slice(top, func(i, j int) bool { return top[i].TotalTime > top[j].TotalTime })
+	if len(top) > topStatements {
+		top = top[:topStatements]
+	}
+	fmt.Println("top statements by total time:")
+	for _, s := range top {
+		fmt.Printf("  %10.1f ms %8d calls  %s: %s\n", s.TotalTime, s.Calls, s.DBName,
+			truncQuery(s.Query))
+	}
+}
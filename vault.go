@@ -0,0 +1,92 @@
+//go:build vault
+
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultField is the field of the Vault secret that has the API key, if not
+// given in --vault-path.
+const vaultField = "api_key"
+
+// vaultGet reads the API key from the Vault KV secret at path, which is like
+// "secret/data/pgdash" (KV version 2) or "kv/pgdash" (version 1), optionally
+// followed by "#FIELD". The Vault server and token are taken from the
+// VAULT_ADDR and VAULT_TOKEN environment variables, and the namespace from
+// VAULT_NAMESPACE, if set.
+func vaultGet(path string) (string, error) {
+	addr, token := os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN")
+	if len(addr) == 0 || len(token) == 0 {
+		return "", errors.New("VAULT_ADDR and VAULT_TOKEN must be set")
+	}
+	path, field, ok := strings.Cut(path, "#")
+	if !ok {
+		field = vaultField
+	}
+
+	req, err := http.NewRequest("GET", strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); len(ns) > 0 {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	c := &http.Client{Timeout: 10 * time.Second}
+	r, err := c.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("vault unreachable: %v", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("no secret found at %q", path)
+	} else if r.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned HTTP status %d for %q", r.StatusCode, path)
+	}
+
+	// KV version 2 has the fields in data.data, version 1 in data
+	var resp struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&resp); err != nil {
+		return "", fmt.Errorf("invalid response from vault: %v", err)
+	}
+	fields := resp.Data
+	if inner, ok := resp.Data["data"]; ok {
+		if _, isMeta := resp.Data["metadata"]; isMeta {
+			fields = nil
+			if err := json.Unmarshal(inner, &fields); err != nil {
+				return "", fmt.Errorf("invalid response from vault: %v", err)
+			}
+		}
+	}
+	var key string
+	if v, ok := fields[field]; !ok || json.Unmarshal(v, &key) != nil || len(key) == 0 {
+		return "", fmt.Errorf("secret at %q has no field %q", path, field)
+	}
+	return key, nil
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"time"
+)
+
+// watching is set while --watch runs commands repeatedly. When set, die does
+// not exit, but instead abandons the current run by panicking with a
+// watchAbort, which is recovered by watch.
+var watching bool
+
+// watchAbort is the panic value used by die while watching. A code of 0 ends
+// the run without it counting as a failure.
+type watchAbort struct {
+	code int
+}
+
+// newRand returns a random number generator, seeded from seed if it is not
+// empty, so that the same seed (like the hostname) always gives the same
+// sequence of numbers.
+func newRand(seed string) *rand.Rand {
+	if len(seed) == 0 {
+		return rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	return rand.New(rand.NewSource(int64(h.Sum64())))
+}
+
+// jitter returns a random duration in [0, max).
+func jitter(rng *rand.Rand, max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rng.Int63n(int64(max)))
+}
+
+// watchOnce calls run, and returns normally even if run calls die. It
+// returns true if run did not call die, or ended the run with status 0.
+func watchOnce(run func()) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			a, isAbort := r.(watchAbort)
+			if !isAbort {
+				panic(r)
+			}
+			ok = a.code == 0
+		}
+	}()
+	run()
+	return true
+}
+
+// watch calls run every --watch interval, forever. The first run is delayed
+// by a random amount up to --jitter, and with --jitter-each, so is every
+// other run. Runs are scheduled relative to the first one, so that the
+// delays do not add up over time.
+func watch(o options, run func()) {
+	rng := newRand(o.jitterSeed)
+	watching = true
+	if len(o.healthAddr) > 0 {
+		startHealthServer(o)
+	}
+	if o.selfEvery > 0 {
+		go logSelfStats(o.selfEvery)
+	}
+	start := time.Now().Add(jitter(rng, o.jitter))
+	next := start
+	for n := 1; ; n++ {
+		if d := time.Until(next); d > 0 {
+			if o.debug {
+				log.Printf("watch: next run at %s", next.Format(time.RFC3339))
+			}
+			time.Sleep(d)
+		}
+		t := time.Now()
+		ok := watchOnce(run)
+		if ok {
+			lastSuccess.Store(time.Now().UnixNano())
+		}
+		self.record(ok, time.Since(t))
+		// skip the runs we missed if this one took too long
+		for time.Now().After(start.Add(time.Duration(n) * o.watch)) {
+			n++
+		}
+		next = start.Add(time.Duration(n) * o.watch)
+		if o.jitterEach {
+			next = next.Add(jitter(rng, o.jitter))
+		}
+	}
+}
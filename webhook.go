@@ -0,0 +1,118 @@
+/*
+ * Copyright 2023 RapidLoop, Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// failureEvent is the JSON payload POSTed to the --on-failure-url webhook. See
+// README.md for the documented schema.
+type failureEvent struct {
+	Command   string `json:"command"`
+	Server    string `json:"server,omitempty"`
+	PgBouncer string `json:"pgbouncer,omitempty"`
+	Pgpool    string `json:"pgpool,omitempty"`
+	Error     string `json:"error"`
+	Timestamp int64  `json:"timestamp"`
+
+	// for --output=json, see apiErrorCode
+	code   string
+	status int
+}
+
+// failure is filled in as the command progresses, and is sent to failureURL
+// if the command fails.
+var (
+	failure    failureEvent
+	failureURL string
+)
+
+const webhookTimeout = 10 * time.Second
+
+// notifyFailure POSTs the failure event with the given error message to the
+// failure webhook, if one is configured. Errors are logged and otherwise
+// ignored.
+func notifyFailure(msg string) {
+	if len(failureURL) == 0 {
+		return
+	}
+	failure.Error = msg
+	failure.Timestamp = time.Now().Unix()
+	body, err := json.Marshal(failure)
+	if err != nil {
+		log.Printf("warning: failed to call on-failure webhook: %v", err)
+		return
+	}
+	c := &http.Client{Timeout: webhookTimeout}
+	r, err := c.Post(failureURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("warning: failed to call on-failure webhook: %v", err)
+		return
+	}
+	r.Body.Close()
+	if r.StatusCode/100 != 2 {
+		log.Printf("warning: on-failure webhook returned HTTP status %d", r.StatusCode)
+	}
+}
+
+// die logs the message, notifies the failure webhook and exits with the given
+// exit code. With --watch, only the current run is abandoned, see watch.
+func die(code int, msg string) {
+	log.Print(msg)
+	r := failureResult(msg)
+	if outputJSON {
+		printJSON(r)
+	}
+	appendSummary(r)
+	notifyFailure(msg)
+	if watching {
+		panic(watchAbort{code: code})
+	}
+	os.Exit(code)
+}
+
+// warnings is the number of warnings logged by warnf in the current run.
+var warnings int
+
+// warnf logs a warning, and counts it for --fail-on-warnings.
+func warnf(format string, v ...interface{}) {
+	log.Printf("warning: "+format, v...)
+	warnings++
+}
+
+// fatal is like log.Fatal, but also notifies the failure webhook.
+func fatal(v ...interface{}) {
+	die(1, fmt.Sprint(v...))
+}
+
+// fatalf is like log.Fatalf, but also notifies the failure webhook.
+func fatalf(format string, v ...interface{}) {
+	die(1, fmt.Sprintf(format, v...))
+}
+
+// fatalCode is like fatalf, but sets the error code for --output=json.
+func fatalCode(code string, format string, v ...interface{}) {
+	failure.code = code
+	fatalf(format, v...)
+}